@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dyne/tgcom/utils/audit"
+	"github.com/dyne/tgcom/utils/modfile"
+	"github.com/dyne/tgcom/utils/server"
+	"github.com/dyne/tgcom/utils/tui"
+	"github.com/dyne/tgcom/utils/tui/modelutils"
+	"github.com/spf13/cobra"
+)
+
+// execAuditor records the changes of the command of a session, nil when
+// tgcom does not run one.
+var execAuditor *audit.Auditor
+
+// checkExec enforces the restrictions of the session when tgcom runs the
+// command of a session of the SSH server: only the root command can be run,
+// on files of the allowed directories, and without modifying them in
+// read-only sessions. Changes are recorded in the audit log. The files
+// include --stdin-filename, and revisions cannot start with -, which git
+// would take as options.
+func checkExec(cmd *cobra.Command) error {
+	if os.Getenv(server.EnvExec) != "1" {
+		return nil
+	}
+	// Scripts only need the error
+	cmd.SilenceUsage = true
+	if cmd != rootCmd {
+		return fmt.Errorf("%s cannot be run over ssh", cmd.CommandPath())
+	}
+	if Tui || remotePath != "" {
+		return errors.New("--tui and --remote cannot be used over ssh: request a terminal to use the TUI")
+	}
+
+	for _, rev := range []string{inputFlag.GitDiff, revision} {
+		if strings.HasPrefix(rev, "-") {
+			return fmt.Errorf("invalid revision %s: it cannot start with -", rev)
+		}
+	}
+	if roots := filepath.SplitList(os.Getenv(server.EnvExecRoots)); len(roots) > 0 {
+		paths := execFiles()
+		for _, path := range []string{inputFlag.BackupDir, inputFlag.StdinFilename} {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+		for _, path := range paths {
+			if !withinRoots(roots, path) {
+				return fmt.Errorf("%s is outside of the allowed directories: %s", path, strings.Join(roots, ", "))
+			}
+		}
+	}
+
+	if os.Getenv(server.EnvExecReadOnly) == "1" && !readOnlyRun() {
+		return fmt.Errorf("%w: use --dry-run, or --stdout with a single file", tui.ErrReadOnly)
+	}
+
+	// Changes are recorded in the audit log of the server
+	auditor, _, err := server.ExecAuditor()
+	if err != nil {
+		return err
+	}
+	execAuditor = &auditor
+	changeFile = auditor.Wrap(changeFile)
+	return nil
+}
+
+// execFiles returns the paths of the files passed to -f, without the line
+// ranges of multiple files and without stdin.
+func execFiles() []string {
+	if FileToRead == "" {
+		return nil
+	}
+	files := []string{FileToRead}
+	if strings.Contains(FileToRead, ",") {
+		files = strings.Split(FileToRead, ",")
+		for i, file := range files {
+			files[i], _, _ = strings.Cut(file, ":")
+		}
+	}
+	var paths []string
+	for _, file := range files {
+		if file != modfile.StdinName {
+			paths = append(paths, file)
+		}
+	}
+	return paths
+}
+
+// withinRoots reports whether path is in one of roots. A path that does not
+// exist yet is checked by its closest existing parent.
+func withinRoots(roots []string, path string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for {
+		if _, err := os.Lstat(path); err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	for _, root := range roots {
+		if modelutils.Within(root, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnlyRun reports whether the flags only print results, without
+// modifying any file.
+func readOnlyRun() bool {
+	if inputFlag.DryRun {
+		return true
+	}
+	if strings.Contains(FileToRead, ",") || commitMsg != "" {
+		return false
+	}
+	return toStdout || revision != "" || FileToRead == "" || FileToRead == modfile.StdinName
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dyne/tgcom/utils/server"
+)
+
+// TestMain runs tgcom instead of the tests in the processes started by
+// runTgcom, so that each run has its own flags.
+func TestMain(m *testing.M) {
+	if os.Getenv("TGCOM_WANT_HELPER_PROCESS") == "1" {
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runTgcom runs tgcom with args in dir, with env added to its environment,
+// and returns its output.
+func runTgcom(t *testing.T, dir string, env []string, args ...string) (string, string, error) {
+	t.Helper()
+	c := exec.Command(os.Args[0], args...)
+	c.Dir = dir
+	c.Env = append(append(os.Environ(), "TGCOM_WANT_HELPER_PROCESS=1"), env...)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// execEnv returns the environment of the command of a session restricted
+// to root, as set up by the server.
+func execEnv(t *testing.T, root string, readOnly bool) []string {
+	t.Helper()
+	env := []string{
+		server.EnvExec + "=1",
+		server.EnvExecRoots + "=" + root,
+		server.EnvExecAuditLog + "=" + filepath.Join(t.TempDir(), "audit.log"),
+		server.EnvExecAuditMaxSize + "=0",
+		server.EnvExecAuditBackups + "=0",
+	}
+	if readOnly {
+		env = append(env, server.EnvExecReadOnly+"=1")
+	}
+	return env
+}
+
+func TestExecFlags(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	output := filepath.Join(outside, "output")
+
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{name: "GitDiffOption", args: []string{"-f", "main.go", "-l", "1", "--git-diff=--output=" + output}, err: "invalid revision --output="},
+		{name: "RevOption", args: []string{"-f", "main.go", "-l", "1", "--rev=--output=" + output}, err: "invalid revision --output="},
+		{name: "StdinFilenameOutside", args: []string{"-", "--stdin-filename", filepath.Join(outside, "main.go"), "--staged"}, err: "is outside of the allowed directories"},
+		{name: "BackupDirOutside", args: []string{"-f", "main.go", "-l", "1", "-b", "--backup-dir", outside}, err: "is outside of the allowed directories"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, stderr, err := runTgcom(t, root, execEnv(t, root, false), tt.args...)
+			if err == nil || !strings.Contains(stderr, tt.err) {
+				t.Errorf("expected an error containing %q, got %v: %q", tt.err, err, stderr)
+			}
+		})
+	}
+	if _, err := os.Stat(output); err == nil {
+		t.Errorf("expected no file to be written outside of the root")
+	}
+}
+
+// snapshot returns the size and modification time of the files and
+// directories under dir, except those under skip.
+func snapshot(t *testing.T, dir, skip string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == skip {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[path] = fmt.Sprintf("%d %s", info.Size(), info.ModTime())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestExecReadOnly(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	// The root is in a repository whose index is outside of it
+	repo := t.TempDir()
+	root := filepath.Join(repo, "root")
+	path := filepath.Join(root, "main.go")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("package main\n\nfunc main() {\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := filepath.Join(root, "unchanged.go")
+	if err := os.WriteFile(unchanged, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, repo, "init", "-q")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	content := "package main\n\nfunc main() {\n\tprintln(1)\n}\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Files with stale stats make git diff refresh the index
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(unchanged, future, future); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	before := snapshot(t, repo, root)
+	env := execEnv(t, root, true)
+
+	allowed := [][]string{
+		{"-f", "main.go", "-l", "4", "--dry-run"},
+		{"-f", "main.go", "--git-diff=HEAD", "--stdout"},
+		{"-f", "main.go", "--staged", "--stdout"},
+		{"-f", "unchanged.go", "--git-diff=HEAD", "--stdout"},
+		{"-f", "main.go", "-l", "3", "--rev", "HEAD"},
+		{"-f", "main.go", "-l", "3", "--rev", ":"},
+	}
+	for _, args := range allowed {
+		if _, stderr, err := runTgcom(t, root, env, args...); err != nil {
+			t.Errorf("%s: No error expected got: %s: %s", strings.Join(args, " "), err, stderr)
+		}
+	}
+	refused := [][]string{
+		{"-f", "main.go", "-l", "4"},
+		{"-f", "main.go", "-l", "4", "-b", "--backup-dir", outside},
+		{"-f", "main.go", "-l", "3", "--rev", "HEAD", "--commit", "variant"},
+		{"-f", "main.go:4,main.go:3", "--stdout"},
+		{"-f", "main.go", "--git-diff=HEAD"},
+		{"-", "--stdin-filename", "main.go", "--git-diff=HEAD"},
+	}
+	for _, args := range refused {
+		if _, _, err := runTgcom(t, root, env, args...); err == nil {
+			t.Errorf("%s: expected the command to be refused", strings.Join(args, " "))
+		}
+	}
+
+	if got, _ := os.ReadFile(path); string(got) != content {
+		t.Errorf("the file was modified: %q", got)
+	}
+	after := snapshot(t, repo, root)
+	for file, state := range after {
+		if before[file] != state {
+			t.Errorf("%s was written outside of the root", file)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+		t.Errorf("expected no backup outside of the root, got %d files", len(entries))
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/dyne/tgcom/utils/config"
+	"github.com/dyne/tgcom/utils/filter"
+	"github.com/dyne/tgcom/utils/modfile"
+	"github.com/spf13/cobra"
+)
+
+// filterCmd groups the git filter driver commands
+var filterCmd = &cobra.Command{
+	Use:   "filter",
+	Short: "Run as a git clean and smudge filter",
+	Long: `Run as a git filter driver, so that the lines selected with the usual
+flags, or with a profile of the configuration file, are committed commented
+out and checked out uncommented. Configure it with:
+
+  git config filter.tgcom.process "tgcom filter process --profile debug"
+  git config filter.tgcom.required true
+  echo "*.go filter=tgcom" >> .gitattributes`,
+}
+
+var filterCleanCmd = &cobra.Command{
+	Use:   "clean [path]",
+	Short: "Comment out the selected lines of stdin, named path, to stdout",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runFilter(filter.Clean, args)
+	},
+}
+
+var filterSmudgeCmd = &cobra.Command{
+	Use:   "smudge [path]",
+	Short: "Uncomment the selected lines of stdin, named path, to stdout",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runFilter(filter.Smudge, args)
+	},
+}
+
+var filterProcessCmd = &cobra.Command{
+	Use:   "process",
+	Short: "Serve git's long-running filter process protocol on stdin and stdout",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := filterConfig()
+		if err := filter.Process(os.Stdin, os.Stdout, conf, log.Default()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	filterCmd.PersistentFlags().StringVarP(&profileName, "profile", "p", "", "pass argument to profile to apply a profile of the configuration file")
+	filterCmd.PersistentFlags().StringVar(&configPath, "config", "", "pass argument to config to read profiles from that file instead of "+config.LocalFile+" or "+config.UserFile)
+
+	filterCmd.AddCommand(filterCleanCmd, filterSmudgeCmd, filterProcessCmd)
+	rootCmd.AddCommand(filterCmd)
+}
+
+// filterConfig returns the selection of the filter, from the flags and the
+// profile.
+func filterConfig() modfile.Config {
+	conf, _, err := loadProfile(inputFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hasSelection(conf) {
+		log.Fatal("Not specified what you want to modify: add -s and -e flags, -l flag, --match, or use a profile")
+	}
+	return conf
+}
+
+// runFilter applies fn to stdin and writes the result to stdout.
+func runFilter(fn func([]byte, string, modfile.Config) ([]byte, error), args []string) {
+	conf := filterConfig()
+	name := inputFlag.StdinFilename
+	if len(args) > 0 {
+		name = args[0]
+	}
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := fn(content, name, conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stdout.Write(result); err != nil {
+		log.Fatal(err)
+	}
+}
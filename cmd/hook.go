@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dyne/tgcom/utils/hook"
+	"github.com/dyne/tgcom/utils/modfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	hookFix       bool
+	hookOverwrite bool
+)
+
+// hookCmd groups the commands managing the git pre-commit hook
+var hookCmd = &cobra.Command{
+	Use:   "hook",
+	Short: "Check labelled sections before committing",
+	Long: `Install or run a git pre-commit hook that fails the commit when staged
+files leave the lines between labels, DEBUG-START and DEBUG-END unless
+-s and -e are given, uncommented.`,
+}
+
+var hookInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install the pre-commit hook in the current repository",
+	Run: func(cmd *cobra.Command, args []string) {
+		startLabel, endLabel := hookLabels()
+		hookArgs := []string{"-s", startLabel, "-e", endLabel}
+		if hookFix {
+			hookArgs = append(hookArgs, "--fix")
+		}
+		path, err := hook.Install(".", hookArgs, hookOverwrite)
+		if err != nil {
+			log.Fatalf("%v (use --overwrite to replace it)", err)
+		}
+		fmt.Printf("Installed %s\n", path)
+	},
+}
+
+var hookRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Check the staged files for uncommented labelled sections",
+	Run: func(cmd *cobra.Command, args []string) {
+		startLabel, endLabel := hookLabels()
+		conf := modfile.Config{StartLabel: startLabel, EndLabel: endLabel, Lang: inputFlag.Lang}
+		problems, err := hook.Check(".", conf, hookFix)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		failed := false
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+			failed = failed || !problem.Fixed
+		}
+		if failed {
+			fmt.Fprintf(os.Stderr, "Comment out the lines between %s and %s, or run tgcom hook run --fix\n", startLabel, endLabel)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	hookInstallCmd.Flags().BoolVar(&hookFix, "fix", false, "pass argument to fix to make the hook comment out the lines instead of failing")
+	hookInstallCmd.Flags().BoolVar(&hookOverwrite, "overwrite", false, "pass argument to overwrite to replace a pre-commit hook not installed by tgcom")
+	hookRunCmd.Flags().BoolVar(&hookFix, "fix", false, "pass argument to fix to comment out the lines and stage the files again")
+
+	hookCmd.AddCommand(hookInstallCmd, hookRunCmd)
+	rootCmd.AddCommand(hookCmd)
+}
+
+// hookLabels returns the labels given with -s and -e, or the default ones.
+func hookLabels() (string, string) {
+	startLabel, endLabel := inputFlag.StartLabel, inputFlag.EndLabel
+	if startLabel == "" {
+		startLabel = hook.DefaultStartLabel
+	}
+	if endLabel == "" {
+		endLabel = hook.DefaultEndLabel
+	}
+	return startLabel, endLabel
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/dyne/tgcom/utils/remote"
+	"github.com/dyne/tgcom/utils/tui"
+	"github.com/dyne/tgcom/utils/tui/modelutils"
+	"github.com/spf13/cobra"
+)
+
+// editOverSSH edits the files of --remote over SSH and SFTP: those given
+// with -f as the flags say, or else the ones selected in the TUI.
+func editOverSSH(cmd *cobra.Command) error {
+	target, err := remote.ParseTarget(remotePath)
+	if err != nil {
+		return err
+	}
+	// The port of the ssh configuration, unless one is given
+	if target.Port == 0 && cmd.Flags().Changed("port") {
+		target.Port = remotePort
+	}
+	client, err := remote.Connect(target.User, target.Host, target.Port, target.Dir)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if FileToRead == "" || Tui {
+		runTUI(tui.Model{
+			State:         "FileSelection",
+			FilesSelector: modelutils.InitialFSModel(client, client.Dir, 20),
+			Editor:        client,
+		})
+		return nil
+	}
+	if revision != "" || toStdout || commitMsg != "" {
+		return errors.New("--rev, --stdout and --commit cannot be used with --ssh")
+	}
+	changeFile = client.ChangeFile
+	ReadFlags(cmd)
+	return nil
+}
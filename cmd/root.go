@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -9,6 +12,8 @@ import (
 	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dyne/tgcom/utils/audit"
+	"github.com/dyne/tgcom/utils/git"
 	"github.com/dyne/tgcom/utils/modfile"
 	"github.com/dyne/tgcom/utils/tui"
 	"github.com/dyne/tgcom/utils/tui/modelutils"
@@ -17,10 +22,17 @@ import (
 )
 
 var (
-	FileToRead string
-	inputFlag  modfile.Config
-	remotePath string
-	Tui        bool
+	FileToRead   string
+	inputFlag    modfile.Config
+	remotePath   string
+	Tui          bool
+	contextLines int
+	revision     string
+	toStdout     bool
+	commitMsg    string
+	overSSH      bool
+	// changeFile changes the files given with -f, those of --remote with --ssh
+	changeFile = modfile.ChangeFile
 )
 
 var rootCmd = &cobra.Command{
@@ -29,9 +41,25 @@ var rootCmd = &cobra.Command{
 	Long: `tgcom is a CLI library written in Go that allows users to
 	comment or uncomment pieces of code. It supports many different
 	languages including Go, C, Java, Python, Bash, and many others...`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 || len(args) == 1 && args[0] != modfile.StdinName {
+			return fmt.Errorf("unexpected argument %q: use -f to pass files, or - to read from stdin", args[0])
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
+		if remotePath != "" && overSSH {
+			if err := editOverSSH(cmd); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 		if remotePath != "" {
-			executeRemoteCommand(remotePath)
+			port, err := serverPort(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			executeRemoteCommand(remotePath, port)
 			return
 		}
 
@@ -54,25 +82,56 @@ func init() {
 	rootCmd.SetHelpFunc(customHelpFunc)
 	rootCmd.SetUsageFunc(customUsageFunc)
 
-	rootCmd.PersistentFlags().StringVarP(&FileToRead, "file", "f", "", "pass argument to the flag and will modify the file content")
+	rootCmd.PersistentFlags().StringVarP(&FileToRead, "file", "f", "", "pass argument to the flag and will modify the file content, - reads from stdin")
+	rootCmd.PersistentFlags().StringVar(&inputFlag.StdinFilename, "stdin-filename", "", "pass argument to stdin-filename to tell the language of stdin from that file name and use it in reports")
 	rootCmd.PersistentFlags().StringVarP(&inputFlag.LineNum, "line", "l", "", "pass argument to line flag and will modify the line in the specified range")
 	rootCmd.PersistentFlags().BoolVarP(&inputFlag.DryRun, "dry-run", "d", false, "pass argument to dry-run flag and will print the result")
 	rootCmd.PersistentFlags().StringVarP(&inputFlag.Action, "action", "a", "toggle", "pass argument to action to comment/uncomment/toggle some lines")
 	rootCmd.PersistentFlags().StringVarP(&inputFlag.StartLabel, "start-label", "s", "", "pass argument to start-label to modify lines after start-label")
 	rootCmd.PersistentFlags().StringVarP(&inputFlag.EndLabel, "end-label", "e", "", "pass argument to end-label to modify lines up to end-label")
 	rootCmd.PersistentFlags().StringVarP(&inputFlag.Lang, "language", "L", "", "pass argument to language to specify the language of the input code")
-	rootCmd.PersistentFlags().StringVarP(&remotePath, "remote", "w", "", "pass remote user, host, and directory in the format user@host:/path/to/directory")
+	rootCmd.PersistentFlags().StringVarP(&remotePath, "remote", "w", "", "pass remote user, host, and directory as [user@]host:/path/to/directory or ssh://[user@]host[:port]/path/to/directory")
+	rootCmd.Flags().BoolVar(&overSSH, "ssh", false, "pass argument to ssh to edit the files of --remote over SSH and SFTP, without a tgcom server on the remote host")
 	rootCmd.PersistentFlags().BoolVarP(&Tui, "tui", "t", false, "run the terminal user interface")
-	// Mark flags based on command name
+	rootCmd.PersistentFlags().StringVar(&inputFlag.Func, "func", "", "pass argument to func to modify the lines of the named function or Type.Method")
+	rootCmd.PersistentFlags().StringVar(&inputFlag.Type, "type", "", "pass argument to type to modify the lines of the named type or class")
+	rootCmd.PersistentFlags().StringVar(&inputFlag.Block, "block", "", "pass argument to block to modify the block whose first line contains the given text")
+	rootCmd.PersistentFlags().StringArrayVar(&inputFlag.Match, "match", nil, "pass argument to match to modify only the lines matching the regular expression, can be repeated")
+	rootCmd.PersistentFlags().StringArrayVar(&inputFlag.NotMatch, "not-match", nil, "pass argument to not-match to skip the lines matching the regular expression, can be repeated")
+	rootCmd.PersistentFlags().StringVar(&inputFlag.Format, "format", modfile.FormatText, "pass argument to format to print the dry-run report as text or json")
+	rootCmd.PersistentFlags().IntVarP(&inputFlag.After, "after-context", "A", 0, "pass argument to after-context to also modify that many lines after each selected line")
+	rootCmd.PersistentFlags().IntVarP(&inputFlag.Before, "before-context", "B", 0, "pass argument to before-context to also modify that many lines before each selected line")
+	rootCmd.PersistentFlags().IntVarP(&contextLines, "context", "C", 0, "pass argument to context to also modify that many lines before and after each selected line")
+	rootCmd.PersistentFlags().BoolVar(&inputFlag.Statement, "statement", false, "pass argument to statement to extend the selection to complete statements and bracket groups")
+	rootCmd.PersistentFlags().StringVar(&inputFlag.GitDiff, "git-diff", "", "pass argument to git-diff to modify only the lines changed since the given revision, such as HEAD")
+	rootCmd.PersistentFlags().BoolVar(&inputFlag.Staged, "staged", false, "pass argument to staged to modify only the lines with changes staged in the git index")
+	rootCmd.PersistentFlags().BoolVar(&inputFlag.Unstaged, "unstaged", false, "pass argument to unstaged to modify only the lines with changes not staged in the git index")
+	rootCmd.PersistentFlags().StringVar(&revision, "rev", "", "pass argument to rev to read the file at the given git revision, or from the index with ':', and print the result")
+	rootCmd.PersistentFlags().BoolVar(&toStdout, "stdout", false, "pass argument to stdout to print the result instead of modifying the file")
+	rootCmd.PersistentFlags().StringVar(&commitMsg, "commit", "", "pass argument to commit to store the result in a new commit on top of --rev, with the given message, and print its id")
+	rootCmd.PersistentFlags().StringVarP(&inputFlag.Backup, "backup", "b", modfile.BackupNone, "pass argument to backup to keep a backup of each modified file: none, simple, numbered or existing")
+	rootCmd.PersistentFlags().Lookup("backup").NoOptDefVal = modfile.BackupExisting
+	rootCmd.PersistentFlags().StringVar(&inputFlag.BackupDir, "backup-dir", "", "pass argument to backup-dir to store backups in that directory instead of next to the file")
+	rootCmd.PersistentFlags().BoolVar(&inputFlag.NoFollow, "no-follow", false, "pass argument to no-follow to replace symlinks with the modified file instead of editing their target")
+	rootCmd.PersistentFlags().BoolVar(&inputFlag.Force, "force", false, "pass argument to force to edit files that look binary")
+	rootCmd.PersistentFlags().StringVarP(&inputFlag.Suffix, "suffix", "S", modfile.DefaultBackupSuffix, "pass argument to suffix to override the suffix of simple backups")
+	// Mark flags of the root command only, subcommands have their own rules
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		if cmd.Name() != "server" {
+		if cmd == rootCmd {
+			// "tgcom -" is the same as "tgcom -f -"
+			if len(args) == 1 && !cmd.Flags().Changed("file") {
+				if err := cmd.Flags().Set("file", args[0]); err != nil {
+					return err
+				}
+			}
 			cmd.MarkFlagsRequiredTogether("start-label", "end-label")
 			cmd.MarkFlagsMutuallyExclusive("line", "start-label")
 			cmd.MarkFlagsMutuallyExclusive("line", "end-label")
-			cmd.MarkFlagsOneRequired("file", "language", "remote", "tui")
-			cmd.MarkFlagsMutuallyExclusive("file", "language")
+			cmd.MarkFlagsOneRequired("file", "language", "stdin-filename", "remote", "tui")
+			cmd.MarkFlagsMutuallyExclusive("line", "start-label", "func", "type", "block")
+			cmd.MarkFlagsMutuallyExclusive("git-diff", "staged", "unstaged")
 		}
-		return nil
+		return checkExec(cmd)
 	}
 
 	// Register server command
@@ -98,30 +157,35 @@ func ReadFlags(cmd *cobra.Command) {
 		}
 
 		// Initialize your model with the current directory
-		model := tui.Model{
+		runTUI(tui.Model{
 			State:         "FileSelection",
 			FilesSelector: modelutils.InitialModel(currentDir, 20),
-		}
-		clearScreen()
-		// Bubble Tea program
-		p := tea.NewProgram(model)
-
-		// Start the program
-		if _, err := p.Run(); err != nil {
-			os.Exit(1)
-		}
-		clearScreen()
+		})
 	} else {
+		if cmd.Flags().Changed("context") {
+			if !cmd.Flags().Changed("before-context") {
+				inputFlag.Before = contextLines
+			}
+			if !cmd.Flags().Changed("after-context") {
+				inputFlag.After = contextLines
+			}
+		}
 
 		if strings.Contains(FileToRead, ",") {
+			if revision != "" || toStdout || commitMsg != "" {
+				log.Fatalf("--rev, --stdout and --commit work on a single file: pass only one file to flag -f")
+			}
 			if cmd.Flags().Changed("line") {
 				fmt.Println("Warning: when passing multiple files to flag -f, don't use -l flag")
 			}
-			if cmd.Flags().Changed("start-label") && cmd.Flags().Changed("end-label") {
+			if stdinCount(strings.Split(FileToRead, ",")) > 1 {
+				log.Fatalf("stdin can only be read once: pass - at most once to flag -f")
+			}
+			if cmd.Flags().Changed("start-label") && cmd.Flags().Changed("end-label") || symbolGiven(cmd) || patternGiven(cmd) || gitGiven(cmd) {
 				fileInfo := strings.Split(FileToRead, ",")
 				for i := 0; i < len(fileInfo); i++ {
 					inputFlag.Filename = fileInfo[i]
-					if err := modfile.ChangeFile(inputFlag); err != nil {
+					if err := changeFile(inputFlag); err != nil {
 						log.Fatal(err)
 					}
 				}
@@ -135,7 +199,7 @@ func ReadFlags(cmd *cobra.Command) {
 						}
 						inputFlag.Filename = parts[0]
 						inputFlag.LineNum = parts[1]
-						if err := modfile.ChangeFile(inputFlag); err != nil {
+						if err := changeFile(inputFlag); err != nil {
 							log.Fatal(err)
 						}
 					} else {
@@ -144,18 +208,123 @@ func ReadFlags(cmd *cobra.Command) {
 				}
 			}
 		} else {
-			if cmd.Flags().Changed("line") || cmd.Flags().Changed("start-label") && cmd.Flags().Changed("end-label") {
+			if cmd.Flags().Changed("line") || cmd.Flags().Changed("start-label") && cmd.Flags().Changed("end-label") || symbolGiven(cmd) || patternGiven(cmd) || gitGiven(cmd) {
 				inputFlag.Filename = FileToRead
-				if err := modfile.ChangeFile(inputFlag); err != nil {
+				if revision != "" || toStdout || commitMsg != "" {
+					err := transformFile(inputFlag)
+					if err != nil {
+						log.Fatal(err)
+					}
+				} else if err := changeFile(inputFlag); err != nil {
 					log.Fatal(err)
 				}
 			} else {
-				log.Fatalf("Not specified what you want to modify: add -l flag or -s and -e flags")
+				log.Fatalf("Not specified what you want to modify: add -l flag, -s and -e flags, --match, --git-diff, --staged, --unstaged, or one of --func, --type and --block")
 			}
 		}
 	}
 }
 
+// runTUI runs the terminal user interface starting with model.
+func runTUI(model tui.Model) {
+	clearScreen()
+	// Bubble Tea program
+	p := tea.NewProgram(model)
+
+	// Start the program
+	if _, err := p.Run(); err != nil {
+		os.Exit(1)
+	}
+	clearScreen()
+}
+
+// stdinCount returns how many of the files stand for stdin, with or
+// without a line range.
+func stdinCount(files []string) int {
+	count := 0
+	for _, file := range files {
+		name, _, _ := strings.Cut(file, ":")
+		if name == modfile.StdinName {
+			count++
+		}
+	}
+	return count
+}
+
+// transformFile writes the modified content of conf.Filename, as it is in
+// the working tree or at the revision given with --rev, to stdout, or with
+// --commit to a new commit on top of that revision. The working tree is
+// left alone.
+func transformFile(conf modfile.Config) error {
+	if conf.Filename == "" || conf.Filename == modfile.StdinName {
+		if revision != "" || commitMsg != "" {
+			return errors.New("--rev and --commit need a file")
+		}
+		// stdin is always written to stdout
+		return modfile.ChangeFile(conf)
+	}
+
+	var input io.Reader
+	var content []byte
+	if revision == "" && commitMsg == "" {
+		file, err := os.Open(conf.Filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	} else {
+		if revision == "" {
+			revision = "HEAD"
+		}
+		var err error
+		if content, err = git.ShowFile(revision, conf.Filename); err != nil {
+			return err
+		}
+		input = bytes.NewReader(content)
+	}
+
+	if commitMsg == "" {
+		return modfile.Change(input, os.Stdout, conf)
+	}
+	if conf.DryRun {
+		return errors.New("--commit cannot be combined with --dry-run")
+	}
+	var output bytes.Buffer
+	if err := modfile.Change(input, &output, conf); err != nil {
+		return err
+	}
+	commit, err := git.CommitFile(revision, conf.Filename, output.Bytes(), commitMsg)
+	if err != nil {
+		return err
+	}
+	if execAuditor != nil {
+		r := execAuditor.NewRecord(conf)
+		r.Before, r.After, r.Commit = audit.Hash(content), audit.Hash(output.Bytes()), commit
+		if err := execAuditor.Log.Write(r); err != nil {
+			return fmt.Errorf("%s was committed but the commit could not be audited: %w", commit, err)
+		}
+	}
+	fmt.Println(commit)
+	return nil
+}
+
+// symbolGiven reports whether lines are selected by the name of a function,
+// type or block.
+func symbolGiven(cmd *cobra.Command) bool {
+	return cmd.Flags().Changed("func") || cmd.Flags().Changed("type") || cmd.Flags().Changed("block")
+}
+
+// patternGiven reports whether lines are selected by regular expression.
+func patternGiven(cmd *cobra.Command) bool {
+	return cmd.Flags().Changed("match") || cmd.Flags().Changed("not-match")
+}
+
+// gitGiven reports whether lines are selected by their changes in git.
+func gitGiven(cmd *cobra.Command) bool {
+	return cmd.Flags().Changed("git-diff") || cmd.Flags().Changed("staged") || cmd.Flags().Changed("unstaged")
+}
+
 func customHelpFunc(cmd *cobra.Command, args []string) {
 	fmt.Println("Tgcom CLI Application")
 	fmt.Println()
@@ -165,13 +334,7 @@ func customHelpFunc(cmd *cobra.Command, args []string) {
 	fmt.Println("  tgcom [flags]")
 	fmt.Println()
 	fmt.Println("Flags:")
-	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
-		if flag.Name == "action" {
-			fmt.Printf("  -%s, --%s: %s (default: %s)\n", flag.Shorthand, flag.Name, flag.Usage, flag.DefValue)
-		} else {
-			fmt.Printf("  -%s, --%s: %s\n", flag.Shorthand, flag.Name, flag.Usage)
-		}
-	})
+	cmd.Flags().VisitAll(printFlag)
 	fmt.Println()
 	fmt.Println("Supported Languages:")
 	for lang := range modfile.CommentChars {
@@ -184,6 +347,27 @@ func customHelpFunc(cmd *cobra.Command, args []string) {
 	fmt.Println()
 	fmt.Println("  # Dry run: show the changes without modifying the file")
 	fmt.Println("  tgcom -f example.go -s START -e END -a toggle -d")
+	fmt.Println()
+	fmt.Println("  # Comment the handleLogin function in server.go")
+	fmt.Println("  tgcom -f server.go --func handleLogin -a comment")
+	fmt.Println()
+	fmt.Println("  # Show which log.Debug calls in lines 10-80 would be commented, as JSON")
+	fmt.Println("  tgcom -f example.go -l 10-80 --match 'log\\.Debug\\(' -a comment -d --format json")
+	fmt.Println()
+	fmt.Println("  # Comment every fmt.Println call, including calls split across lines")
+	fmt.Println("  tgcom -f example.go --match 'fmt\\.Println' --statement -a comment")
+	fmt.Println()
+	fmt.Println("  # Uncomment the lines changed since the last commit")
+	fmt.Println("  tgcom -f example.go --git-diff HEAD -a uncomment")
+	fmt.Println()
+	fmt.Println("  # Print config.go as released in v1.2.0 with the PROD section toggled")
+	fmt.Println("  tgcom --rev v1.2.0 -f config.go -s PROD -e PROD_END --stdout")
+	fmt.Println()
+	fmt.Println("  # Use tgcom as a filter, telling the language from a file name")
+	fmt.Println("  cat main.go | tgcom - --stdin-filename main.go -s START -e END")
+	fmt.Println()
+	fmt.Println("  # Keep numbered backups of example.go in ./backups")
+	fmt.Println("  tgcom -f example.go -l 3 --backup=numbered --backup-dir backups")
 }
 
 func customUsageFunc(cmd *cobra.Command) error {
@@ -192,15 +376,23 @@ func customUsageFunc(cmd *cobra.Command) error {
 	fmt.Printf("  %s\n", cmd.UseLine())
 	fmt.Println()
 	fmt.Println("Flags:")
-	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
-		if flag.Name == "action" {
-			fmt.Printf("  -%s, --%s: %s (default: %s)\n", flag.Shorthand, flag.Name, flag.Usage, flag.DefValue)
-		} else {
-			fmt.Printf("  -%s, --%s: %s\n", flag.Shorthand, flag.Name, flag.Usage)
-		}
-	})
+	cmd.Flags().VisitAll(printFlag)
 	return nil
 }
+
+func printFlag(flag *pflag.Flag) {
+	name := "    --" + flag.Name
+	if flag.Shorthand != "" {
+		name = fmt.Sprintf("-%s, --%s", flag.Shorthand, flag.Name)
+	}
+	switch flag.Name {
+	case "action", "backup", "format":
+		fmt.Printf("  %s: %s (default: %s)\n", name, flag.Usage, flag.DefValue)
+	default:
+		fmt.Printf("  %s: %s\n", name, flag.Usage)
+	}
+}
+
 func clearScreen() {
 	var cmd *exec.Cmd
 	switch runtime.GOOS {
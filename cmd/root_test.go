@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runGit runs git with args in dir.
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	c := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	c.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	if out, err := c.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %s", args[0], out)
+	}
+}
+
+func TestGitFlags(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(path, []byte("package main\n\nfunc main() {\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "add", "main.go")
+	runGit(t, dir, "commit", "-q", "-m", "initial")
+	if err := os.WriteFile(path, []byte("package main\n\nfunc main() {\n\t// println(1)\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", "main.go")
+	if err := os.WriteFile(path, []byte("package main\n\nfunc main() {\n\t// println(1)\n\t// println(2)\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{name: "GitDiff", args: []string{"--git-diff", "HEAD"}, expected: "\tprintln(1)\n\tprintln(2)\n"},
+		{name: "GitDiffEquals", args: []string{"--git-diff=HEAD"}, expected: "\tprintln(1)\n\tprintln(2)\n"},
+		{name: "Staged", args: []string{"--staged"}, expected: "\tprintln(1)\n\t// println(2)\n"},
+		{name: "Unstaged", args: []string{"--unstaged"}, expected: "\t// println(1)\n\tprintln(2)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-f", "main.go", "-a", "uncomment", "--stdout"}, tt.args...)
+			stdout, stderr, err := runTgcom(t, dir, nil, args...)
+			if err != nil {
+				t.Fatalf("No error expected got: %s: %s", err, stderr)
+			}
+			if want := "package main\n\nfunc main() {\n" + tt.expected + "}\n"; stdout != want {
+				t.Errorf("expected %q, got %q", want, stdout)
+			}
+		})
+	}
+
+	// A revision is required
+	if _, stderr, err := runTgcom(t, dir, nil, "-f", "main.go", "--git-diff"); err == nil || !strings.Contains(stderr, "flag needs an argument") {
+		t.Errorf("expected an error without a revision, got %v: %q", err, stderr)
+	}
+}
+
+func TestMultipleFilesTransform(t *testing.T) {
+	dir := t.TempDir()
+	content := "package main\n\nfunc main() {\n\tprintln(1)\n}\n"
+	for _, file := range []string{"a.go", "b.go"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, flags := range [][]string{{"--stdout"}, {"--rev", "HEAD"}, {"--rev", "HEAD", "--commit", "variant"}} {
+		for _, files := range [][]string{{"-f", "a.go:4,b.go:4"}, {"-f", "a.go,b.go", "--match", "println"}} {
+			args := append(files, flags...)
+			_, stderr, err := runTgcom(t, dir, nil, args...)
+			if err == nil || !strings.Contains(stderr, "work on a single file") {
+				t.Errorf("%s: expected an error, got %v: %q", strings.Join(args, " "), err, stderr)
+			}
+		}
+	}
+	for _, file := range []string{"a.go", "b.go"} {
+		if got, _ := os.ReadFile(filepath.Join(dir, file)); string(got) != content {
+			t.Errorf("%s was modified: %q", file, got)
+		}
+	}
+}
@@ -1,125 +1,213 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
-	"os/signal"
+	"strconv"
 	"strings"
-	"syscall"
-	"time"
 
-	"github.com/creack/pty"
+	"github.com/dyne/tgcom/utils/audit"
+	"github.com/dyne/tgcom/utils/config"
+	"github.com/dyne/tgcom/utils/remote"
 	"github.com/dyne/tgcom/utils/server"
 	"github.com/spf13/cobra"
-	"golang.org/x/term"
+	"golang.org/x/crypto/ssh"
+)
+
+// Environment variables overriding the configuration file
+const (
+	envListen         = "TGCOM_LISTEN"          // listen addresses separated by commas
+	envHostKey        = "TGCOM_HOST_KEY"        // path of the host key
+	envAuthorizedKeys = "TGCOM_AUTHORIZED_KEYS" // path of the authorized_keys file
+	envPort           = "TGCOM_PORT"            // port of the server used with -w
+	envAuditLog       = "TGCOM_AUDIT_LOG"       // path of the audit log
+)
+
+var (
+	listenAddrs        []string
+	hostKeyPath        string
+	authorizedKeysPath string
+	noAuth             bool
+	serverReadOnly     bool
+	roots              []string
+	remotePort         int
+	auditLogPath       string
+	auditMaxSize       int
+	auditBackups       int
 )
 
 // serverCmd represents the server command
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Start the SSH server",
-	Long:  `Start the SSH server that allows remote interactions with tgcom.`,
+	Long: `Start the SSH server that allows remote interactions with tgcom.
+
+Only the public keys of the authorized_keys file can connect. A key can be
+restricted to a directory with the root="/path" option, and to browsing
+files without modifying them with the read-only option:
+
+  root="/srv/project",read-only ssh-ed25519 AAAA... alice
+
+With --read-only, every session is read-only. Read-only sessions show the
+diff of the changes selected in the TUI instead of applying them, and their
+commands can only use --dry-run, --stdout and stdin.
+
+With --root, sessions of other keys can only browse the given directories.
+Relative directories are looked up in the roots, and the first root is
+opened when none is requested.
+
+Commands of sessions without a terminal, such as
+"ssh -p 2222 host tgcom -f main.go -l 3 --dry-run", are run by tgcom in the
+first root, with the same restrictions, and return their output and exit
+status.
+
+Every change made to a file by a session, in the TUI or by a command, is
+recorded as a line of JSON in the audit log, with the user, the fingerprint
+of the key, the file, the action, the selected lines and the SHA-256 of the
+content before and after the change. The log is rotated when it reaches
+--audit-max-size megabytes.
+
+Settings are read from the server section of the configuration file, then
+from the ` + envListen + `, ` + envHostKey + `, ` + envAuthorizedKeys + ` and ` + envAuditLog + ` environment
+variables, then from the flags.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		server.StartServer()
+		conf, err := serverConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.StartServer(conf)
 	},
 }
 
 func init() {
+	serverCmd.Flags().StringArrayVar(&listenAddrs, "listen", nil, fmt.Sprintf("pass argument to listen to listen on host:port, [ipv6]:port or unix:/path/to/socket instead of :%d, can be repeated", server.DefaultPort))
+	serverCmd.Flags().StringVar(&hostKeyPath, "host-key", "", "pass argument to host-key to use that host key, created if missing")
+	serverCmd.Flags().StringVar(&authorizedKeysPath, "authorized-keys", "", "pass argument to authorized-keys to accept the public keys of that file instead of tgcom/authorized_keys in the user configuration directory")
+	serverCmd.Flags().StringArrayVar(&roots, "root", nil, "pass argument to root to only let sessions browse that directory, can be repeated")
+	serverCmd.Flags().StringVar(&auditLogPath, "audit-log", "", "pass argument to audit-log to record the changes made by sessions in that file instead of tgcom/audit.log in the user data directory")
+	serverCmd.Flags().IntVar(&auditMaxSize, "audit-max-size", audit.DefaultMaxSize>>20, "pass argument to audit-max-size to rotate the audit log when it reaches that many megabytes")
+	serverCmd.Flags().IntVar(&auditBackups, "audit-backups", audit.DefaultMaxBackups, "pass argument to audit-backups to keep that many rotated audit logs")
+	serverCmd.Flags().BoolVar(&serverReadOnly, "read-only", false, "pass argument to read-only to let all sessions browse files and preview changes without modifying anything")
+	serverCmd.Flags().BoolVar(&noAuth, "no-auth", false, "pass argument to no-auth to accept any connection without authentication")
+	serverCmd.Flags().StringVar(&configPath, "config", "", "pass argument to config to read settings from that file instead of "+config.LocalFile+" or "+config.UserFile)
+	rootCmd.Flags().IntVar(&remotePort, "port", server.DefaultPort, "pass argument to port to connect to the tgcom server of --remote on that port, or to its SSH server with --ssh, unless the target has a port")
+
 	// Register the server command
 	rootCmd.AddCommand(serverCmd)
 }
 
-func executeRemoteCommand(remotePath string) {
-	parts := strings.SplitN(remotePath, "@", 2)
-	if len(parts) != 2 {
-		fmt.Println("Invalid format. Usage: tgcom -w user@remote:/path/folder")
-		os.Exit(1)
+// loadConfig reads the configuration file given with --config, or the
+// default one if there is any.
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(configPath)
+	if configPath == "" && errors.Is(err, config.ErrNoConfig) {
+		return &config.Config{}, nil
 	}
+	return cfg, err
+}
 
-	userHost := parts[0]
-	pathParts := strings.SplitN(parts[1], ":", 2)
-	if len(pathParts) != 2 {
-		fmt.Println("Invalid format. Usage: tgcom -w user@remote:/path/folder")
-		os.Exit(1)
+// serverConfig returns the settings of the server from the configuration
+// file, overridden by the environment and then by the flags.
+func serverConfig(cmd *cobra.Command) (server.Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return server.Config{}, err
 	}
-
-	host := pathParts[0]
-	dir := pathParts[1]
-
-	sshCmd := "ssh"
-	sshArgs := []string{"-t", "-p", "2222", userHost + "@" + host, "tgcom", dir}
-
-	// Start SSH command with PTY
-	if err := startSSHWithPTY(sshCmd, sshArgs); err != nil {
-		log.Fatalf("Error starting SSH with PTY: %v", err)
+	conf := server.Config{Listen: cfg.Server.Listen, HostKey: cfg.Server.HostKey, AuthorizedKeys: cfg.Server.AuthorizedKeys, Roots: cfg.Server.Roots, ReadOnly: cfg.Server.ReadOnly || serverReadOnly, NoAuth: noAuth,
+		AuditLog: cfg.Server.AuditLog, AuditMaxSize: int64(cfg.Server.AuditMaxSize) << 20, AuditBackups: cfg.Server.AuditBackups}
+	if value, ok := os.LookupEnv(envListen); ok {
+		conf.Listen = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	if value, ok := os.LookupEnv(envHostKey); ok {
+		conf.HostKey = value
+	}
+	if value, ok := os.LookupEnv(envAuthorizedKeys); ok {
+		conf.AuthorizedKeys = value
+	}
+	if value, ok := os.LookupEnv(envAuditLog); ok {
+		conf.AuditLog = value
+	}
+	if cmd.Flags().Changed("listen") {
+		conf.Listen = listenAddrs
+	}
+	if cmd.Flags().Changed("host-key") {
+		conf.HostKey = hostKeyPath
+	}
+	if cmd.Flags().Changed("authorized-keys") {
+		conf.AuthorizedKeys = authorizedKeysPath
 	}
+	if cmd.Flags().Changed("root") {
+		conf.Roots = roots
+	}
+	if cmd.Flags().Changed("audit-log") {
+		conf.AuditLog = auditLogPath
+	}
+	if cmd.Flags().Changed("audit-max-size") {
+		conf.AuditMaxSize = int64(auditMaxSize) << 20
+	}
+	if cmd.Flags().Changed("audit-backups") {
+		conf.AuditBackups = auditBackups
+	}
+	if conf.AuditMaxSize < 0 || conf.AuditBackups < 0 {
+		return server.Config{}, errors.New("the size and the number of backups of the audit log cannot be negative")
+	}
+	return conf, nil
 }
 
-func startSSHWithPTY(cmd string, args []string) error {
-	// Create SSH command
-	sshCommand := exec.Command(cmd, args...)
-
-	// Start PTY
-	ptmx, err := pty.Start(sshCommand)
-	if err != nil {
-		return fmt.Errorf("failed to start PTY: %w", err)
+// serverPort returns the port given with --port, or else from the
+// environment or the configuration file.
+func serverPort(cmd *cobra.Command) (int, error) {
+	if cmd.Flags().Changed("port") {
+		return remotePort, nil
 	}
-	defer ptmx.Close()
-
-	// Set terminal attributes
-	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if value, ok := os.LookupEnv(envPort); ok {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", envPort, value)
+		}
+		return port, nil
+	}
+	cfg, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("failed to make terminal raw: %w", err)
+		return 0, err
 	}
-	defer term.Restore(int(os.Stdin.Fd()), oldState)
-
-	// Resize PTY to current terminal size
-	if err := resizePTY(ptmx); err != nil {
-		return fmt.Errorf("failed to resize PTY: %w", err)
+	if cfg.Remote.Port != 0 {
+		return cfg.Remote.Port, nil
 	}
+	return remotePort, nil
+}
 
-	// Forward input to PTY
-	go func() {
-		_, _ = io.Copy(ptmx, os.Stdin)
-	}()
-
-	// Forward output from PTY
-	go func() {
-		_, _ = io.Copy(os.Stdout, ptmx)
-	}()
-
-	// Handle PTY signals and resize
-	go func() {
-		ch := make(chan os.Signal, 1)
-		signal.Notify(ch, syscall.SIGWINCH)
-		for range ch {
-			if err := resizePTY(ptmx); err != nil {
-				log.Printf("Error resizing PTY: %v", err)
-			}
-		}
-	}()
-
-	// Wait for SSH command to finish
-	if err := sshCommand.Wait(); err != nil {
-		return fmt.Errorf("SSH command failed: %w", err)
+// executeRemoteCommand opens the TUI of the tgcom server of remotePath,
+// listening on port unless the target has one, in the local terminal, and
+// exits with its status.
+func executeRemoteCommand(remotePath string, port int) {
+	target, err := remote.ParseTarget(remotePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if target.Port != 0 {
+		port = target.Port
 	}
 
-	// Wait a bit before exiting to ensure all output is processed
-	time.Sleep(100 * time.Millisecond)
-
-	return nil
-}
-
-func resizePTY(ptmx *os.File) error {
-	size, err := pty.GetsizeFull(os.Stdin)
+	conn, err := remote.Dial(target.User, target.Host, port)
 	if err != nil {
-		return fmt.Errorf("failed to get terminal size: %w", err)
+		log.Fatal(err)
 	}
-	if err := pty.Setsize(ptmx, size); err != nil {
-		return fmt.Errorf("failed to set terminal size: %w", err)
+	// Without a directory the server opens its first root
+	command := "tgcom"
+	if target.Dir != "" {
+		command += " " + remote.Quote(target.Dir)
+	}
+	err = remote.RunTerminal(conn, command, os.Stdin, os.Stdout)
+	conn.Close()
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitStatus())
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-	return nil
 }
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dyne/tgcom/utils/config"
+	"github.com/dyne/tgcom/utils/modfile"
+	"github.com/dyne/tgcom/utils/watch"
+	"github.com/spf13/cobra"
+)
+
+var (
+	profileName string
+	configPath  string
+	debounce    time.Duration
+)
+
+// watchCmd re-applies changes to files whenever they are written
+var watchCmd = &cobra.Command{
+	Use:   "watch [paths...]",
+	Short: "Re-apply changes to files whenever they are written",
+	Long: `Watch files, directories or glob patterns in file names and re-apply the
+changes selected with the usual flags, or with a profile of the
+configuration file, every time a file is written.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, files, err := loadProfile(inputFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		paths := args
+		if len(paths) == 0 {
+			paths = files
+		}
+		if len(paths) == 0 {
+			log.Fatal("no paths to watch: pass them as arguments or list them in the files of the profile")
+		}
+		if !hasSelection(conf) {
+			log.Fatal("Not specified what you want to modify: add -l flag, -s and -e flags, --match, or use a profile")
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		log.Printf("watching %s", strings.Join(paths, ", "))
+		if err := watch.Run(ctx, paths, conf, debounce, log.Default()); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("stopping watch...")
+	},
+}
+
+func init() {
+	watchCmd.Flags().StringVarP(&profileName, "profile", "p", "", "pass argument to profile to apply a profile of the configuration file")
+	watchCmd.Flags().StringVar(&configPath, "config", "", "pass argument to config to read profiles from that file instead of "+config.LocalFile+" or "+config.UserFile)
+	watchCmd.Flags().DurationVar(&debounce, "debounce", watch.DefaultDebounce, "pass argument to debounce to wait that long after the last write before applying the changes")
+
+	rootCmd.AddCommand(watchCmd)
+}
+
+// loadProfile returns conf with the profile given with --profile applied,
+// and the files listed in the profile.
+func loadProfile(conf modfile.Config) (modfile.Config, []string, error) {
+	if profileName == "" {
+		return conf, nil, nil
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return conf, nil, err
+	}
+	profile, err := cfg.Profile(profileName)
+	if err != nil {
+		return conf, nil, err
+	}
+	return profile.Apply(conf), profile.Files, nil
+}
+
+// hasSelection reports whether conf selects any line to modify.
+func hasSelection(conf modfile.Config) bool {
+	return conf.LineNum != "" || conf.StartLabel != "" && conf.EndLabel != "" ||
+		conf.Func != "" || conf.Type != "" || conf.Block != "" ||
+		len(conf.Match) > 0 || len(conf.NotMatch) > 0
+}
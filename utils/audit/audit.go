@@ -0,0 +1,226 @@
+// Package audit records the changes made to files on behalf of the clients
+// of the SSH server, as JSON lines in a log file that is rotated when it
+// grows too large. The log can be written by several processes at once.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+// Defaults of the rotation of the log.
+const (
+	DefaultMaxSize    = 10 << 20 // bytes
+	DefaultMaxBackups = 5
+)
+
+// Record is a line of the audit log.
+type Record struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Key        string    `json:"key,omitempty"`         // SHA256 fingerprint of the key of the client
+	KeyComment string    `json:"key_comment,omitempty"` // Comment of the key in the authorized_keys file
+	Remote     string    `json:"remote,omitempty"`      // Address of the client
+	File       string    `json:"file"`
+	Action     string    `json:"action"`
+	Lines      string    `json:"lines,omitempty"`
+	StartLabel string    `json:"start_label,omitempty"`
+	EndLabel   string    `json:"end_label,omitempty"`
+	Func       string    `json:"func,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	Block      string    `json:"block,omitempty"`
+	Match      []string  `json:"match,omitempty"`
+	NotMatch   []string  `json:"not_match,omitempty"`
+	GitDiff    string    `json:"git_diff,omitempty"`
+	Staged     bool      `json:"staged,omitempty"`
+	Unstaged   bool      `json:"unstaged,omitempty"`
+	Before     string    `json:"before,omitempty"` // SHA-256 of the content before the change
+	After      string    `json:"after,omitempty"`  // SHA-256 of the content after the change
+	Commit     string    `json:"commit,omitempty"` // Commit created instead of changing the file
+	Error      string    `json:"error,omitempty"`
+}
+
+// Client identifies who changes the files.
+type Client struct {
+	User       string
+	Key        string // SHA256 fingerprint, empty without authentication
+	KeyComment string
+	Remote     string
+}
+
+// Logger appends records to the log file at Path. Before a record would
+// make it larger than MaxSize, the file is renamed to Path.1, the previous
+// Path.1 to Path.2 and so on, keeping MaxBackups of them.
+type Logger struct {
+	Path       string
+	MaxSize    int64 // Defaults to DefaultMaxSize
+	MaxBackups int   // Defaults to DefaultMaxBackups
+
+	mu sync.Mutex
+}
+
+// Write appends r to the log, creating its directory if needed.
+func (l *Logger) Write(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0700); err != nil {
+		return err
+	}
+	// Other processes write to the log too: the lock is taken on a file
+	// that is never rotated
+	lock, err := os.OpenFile(l.Path+".lock", os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := modfile.LockFile(lock); err != nil {
+		return err
+	}
+
+	maxSize := l.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if info, err := os.Stat(l.Path); err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("cannot rotate the audit log: %w", err)
+		}
+	}
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rotate renames the log to its first backup, shifting the others and
+// dropping the oldest one.
+func (l *Logger) rotate() error {
+	backups := l.MaxBackups
+	if backups <= 0 {
+		backups = DefaultMaxBackups
+	}
+	backup := func(i int) string { return l.Path + "." + strconv.Itoa(i) }
+	for i := backups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.Path, backup(1))
+}
+
+// Auditor records in Log the changes made to files on behalf of Client. It
+// can be used as the Editor of the TUI.
+type Auditor struct {
+	Log    *Logger
+	Client Client
+}
+
+// ReadFile is os.ReadFile.
+func (a Auditor) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// TakeSnapshot is modfile.TakeSnapshot.
+func (a Auditor) TakeSnapshot(name string) (modfile.Snapshot, error) {
+	return modfile.TakeSnapshot(name)
+}
+
+// ChangeFile is modfile.ChangeFile, recording the change.
+func (a Auditor) ChangeFile(conf modfile.Config) error {
+	return a.Wrap(modfile.ChangeFile)(conf)
+}
+
+// Wrap returns change recording the changes it makes. Dry runs and stdin
+// do not modify any file, so they are not recorded. Failed changes are
+// recorded with their error, since they may have modified the file anyway.
+// The contents before and after the change are the ones change read and
+// wrote under the lock of the file, so that a concurrent change is never
+// recorded as this one.
+func (a Auditor) Wrap(change func(modfile.Config) error) func(modfile.Config) error {
+	return func(conf modfile.Config) error {
+		if conf.DryRun || conf.Filename == "" || conf.Filename == modfile.StdinName {
+			return change(conf)
+		}
+		r := a.NewRecord(conf)
+		var original, written modfile.Snapshot
+		conf.Original = &original
+		conf.Written = &written
+		err := change(conf)
+		// A change failing before it read the file left it alone, and one
+		// failing before it replaced the file left the original
+		if !original.ModTime.IsZero() {
+			r.Before = hex.EncodeToString(original.Hash[:])
+			r.After = r.Before
+		}
+		if !written.ModTime.IsZero() {
+			r.After = hex.EncodeToString(written.Hash[:])
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		if logErr := a.Log.Write(r); logErr != nil {
+			return errors.Join(err, fmt.Errorf("%s may have been changed but the change could not be audited: %w", conf.Filename, logErr))
+		}
+		return err
+	}
+}
+
+// NewRecord returns the record of a change of the file of conf by the
+// client, without the hashes of the content.
+func (a Auditor) NewRecord(conf modfile.Config) Record {
+	file := conf.Filename
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	action := conf.Action
+	if action == "" {
+		action = "toggle"
+	}
+	return Record{
+		Time:       time.Now().UTC(),
+		User:       a.Client.User,
+		Key:        a.Client.Key,
+		KeyComment: a.Client.KeyComment,
+		Remote:     a.Client.Remote,
+		File:       file,
+		Action:     action,
+		Lines:      conf.LineNum,
+		StartLabel: conf.StartLabel,
+		EndLabel:   conf.EndLabel,
+		Func:       conf.Func,
+		Type:       conf.Type,
+		Block:      conf.Block,
+		Match:      conf.Match,
+		NotMatch:   conf.NotMatch,
+		GitDiff:    conf.GitDiff,
+		Staged:     conf.Staged,
+		Unstaged:   conf.Unstaged,
+	}
+}
+
+// Hash returns the hexadecimal SHA-256 of content, as used in records.
+func Hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,157 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+// readLog returns the records of the log file at path.
+func readLog(t *testing.T, path string) []Record {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid line %q: %s", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestLoggerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "audit.log")
+	// The records have the same length, and 2 fit in a file
+	line, _ := json.Marshal(Record{User: "alice", File: "1", Action: "comment"})
+	log := &Logger{Path: path, MaxSize: int64(2 * (len(line) + 1)), MaxBackups: 2}
+	for _, file := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+		if err := log.Write(Record{User: "alice", File: file, Action: "comment"}); err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+	}
+	files := map[string]string{path: "7", path + ".1": "5,6", path + ".2": "3,4"}
+	for file, want := range files {
+		var got []string
+		for _, r := range readLog(t, file) {
+			got = append(got, r.File)
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("%s: expected the records of %s, got %v", file, want, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the log to be private, got %v", info.Mode())
+	}
+}
+
+func TestLoggerConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Loggers of different processes only share the file
+	logs := []*Logger{{Path: path}, {Path: path}}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(log *Logger) {
+			defer wg.Done()
+			if err := log.Write(Record{User: "alice", File: strings.Repeat("x", 5000), Action: "comment"}); err != nil {
+				t.Errorf("No error expected got: %s", err)
+			}
+		}(logs[i%2])
+	}
+	wg.Wait()
+	if records := readLog(t, path); len(records) != 50 {
+		t.Errorf("expected 50 records, got %d", len(records))
+	}
+}
+
+func TestAuditor(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	before := "package main\n\nfunc main() {\n\tprintln(1)\n}\n"
+	if err := os.WriteFile(path, []byte(before), 0644); err != nil {
+		t.Fatal(err)
+	}
+	log := &Logger{Path: filepath.Join(dir, "audit.log")}
+	auditor := Auditor{Log: log, Client: Client{User: "alice", Key: "SHA256:abc", KeyComment: "alice@laptop", Remote: "127.0.0.1:4242"}}
+
+	if err := auditor.ChangeFile(modfile.Config{Filename: path, LineNum: "4", Action: "comment"}); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	// Dry runs do not change files
+	if err := auditor.ChangeFile(modfile.Config{Filename: path, LineNum: "4", Action: "uncomment", DryRun: true}); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	err := auditor.ChangeFile(modfile.Config{Filename: path, StartLabel: "START", EndLabel: "END", Action: "remove"})
+	if err == nil {
+		t.Fatalf("expected an error for an invalid action")
+	}
+
+	after, _ := os.ReadFile(path)
+	records := readLog(t, log.Path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	r := records[0]
+	if r.User != "alice" || r.Key != "SHA256:abc" || r.KeyComment != "alice@laptop" || r.Remote != "127.0.0.1:4242" {
+		t.Errorf("unexpected client in %+v", r)
+	}
+	if r.File != path || r.Action != "comment" || r.Lines != "4" || r.Error != "" || r.Time.IsZero() {
+		t.Errorf("unexpected change in %+v", r)
+	}
+	if r.Before != Hash([]byte(before)) || r.After != Hash(after) || r.Before == r.After {
+		t.Errorf("unexpected hashes in %+v", r)
+	}
+
+	r = records[1]
+	if r.Action != "remove" || r.StartLabel != "START" || r.EndLabel != "END" || r.Error != err.Error() || r.Before != r.After {
+		t.Errorf("unexpected failed change %+v", r)
+	}
+}
+
+func TestAuditorConcurrentChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(path, []byte("package main\n\nfunc main() {\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Another process changes the file before the change takes its lock,
+	// and again once the change released it
+	concurrent := "package main\n\nfunc main() {\n\tprintln(1)\n}\n"
+	later := "package main\n"
+	change := func(conf modfile.Config) error {
+		if err := os.WriteFile(path, []byte(concurrent), 0644); err != nil {
+			return err
+		}
+		if err := modfile.ChangeFile(conf); err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(later), 0644)
+	}
+	auditor := Auditor{Log: &Logger{Path: filepath.Join(dir, "audit.log")}, Client: Client{User: "alice"}}
+	if err := auditor.Wrap(change)(modfile.Config{Filename: path, LineNum: "4", Action: "comment"}); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+
+	after := "package main\n\nfunc main() {\n// \tprintln(1)\n}\n"
+	records := readLog(t, auditor.Log.Path)
+	if len(records) != 1 || records[0].Before != Hash([]byte(concurrent)) || records[0].After != Hash([]byte(after)) {
+		t.Errorf("expected the hash of the content read by the change, got %+v", records)
+	}
+}
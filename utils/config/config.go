@@ -0,0 +1,141 @@
+// Package config loads the tgcom configuration file, which holds named
+// profiles: sets of options applied together by commands such as watch, and
+// the settings of the SSH server and of the remote client.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/dyne/tgcom/utils/modfile"
+	"gopkg.in/yaml.v3"
+)
+
+// LocalFile is looked up in the current directory before the user
+// configuration file.
+const LocalFile = ".tgcom.yaml"
+
+// UserFile is the configuration file in the XDG configuration directory.
+var UserFile = filepath.Join(xdg.ConfigHome, "tgcom", "config.yaml")
+
+// ErrNoConfig is returned when no configuration file exists.
+var ErrNoConfig = errors.New("no configuration file found")
+
+// Config is the content of a configuration file.
+type Config struct {
+	Profiles map[string]Profile `yaml:"profiles"`
+	Server   Server             `yaml:"server"`
+	Remote   Remote             `yaml:"remote"`
+}
+
+// Server holds the settings of tgcom server, which mirror its flags.
+type Server struct {
+	Listen         []string `yaml:"listen"`
+	HostKey        string   `yaml:"host-key"`
+	AuthorizedKeys string   `yaml:"authorized-keys"`
+	Roots          []string `yaml:"roots"`
+	ReadOnly       bool     `yaml:"read-only"`
+	AuditLog       string   `yaml:"audit-log"`
+	AuditMaxSize   int      `yaml:"audit-max-size"` // megabytes
+	AuditBackups   int      `yaml:"audit-backups"`
+}
+
+// Remote holds the settings used to connect to a tgcom server with -w.
+type Remote struct {
+	Port int `yaml:"port"`
+}
+
+// Profile is a named set of options. Its fields mirror the command line
+// flags of the same name.
+type Profile struct {
+	Files      []string `yaml:"files"` // files, directories or glob patterns the profile applies to
+	Line       string   `yaml:"line"`
+	StartLabel string   `yaml:"start-label"`
+	EndLabel   string   `yaml:"end-label"`
+	Language   string   `yaml:"language"`
+	Action     string   `yaml:"action"`
+	Match      []string `yaml:"match"`
+	NotMatch   []string `yaml:"not-match"`
+	Func       string   `yaml:"func"`
+	Type       string   `yaml:"type"`
+	Block      string   `yaml:"block"`
+	Statement  bool     `yaml:"statement"`
+	Backup     string   `yaml:"backup"`
+}
+
+// Load reads the configuration file at path. An empty path selects
+// LocalFile if it exists, or else UserFile. Unknown keys are rejected, so
+// that a misspelled option is not silently ignored.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		for _, candidate := range []string{LocalFile, UserFile} {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return nil, fmt.Errorf("%w: create %s or %s", ErrNoConfig, LocalFile, UserFile)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var conf Config
+	dec := yaml.NewDecoder(file)
+	dec.KnownFields(true)
+	// An empty file is an empty configuration
+	if err := dec.Decode(&conf); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return &conf, nil
+}
+
+// Profile returns the profile called name.
+func (c *Config) Profile(name string) (Profile, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for name := range c.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("unknown profile %q. Available profiles: %s", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// Apply returns conf with the options set in the profile.
+func (p Profile) Apply(conf modfile.Config) modfile.Config {
+	set := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	set(&conf.LineNum, p.Line)
+	set(&conf.StartLabel, p.StartLabel)
+	set(&conf.EndLabel, p.EndLabel)
+	set(&conf.Lang, p.Language)
+	set(&conf.Action, p.Action)
+	set(&conf.Func, p.Func)
+	set(&conf.Type, p.Type)
+	set(&conf.Block, p.Block)
+	set(&conf.Backup, p.Backup)
+	if p.Match != nil {
+		conf.Match = p.Match
+	}
+	if p.NotMatch != nil {
+		conf.NotMatch = p.NotMatch
+	}
+	conf.Statement = conf.Statement || p.Statement
+	return conf
+}
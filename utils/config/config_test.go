@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `profiles:
+  generated:
+    files: [gen/*.go]
+    start-label: DEBUG-START
+    end-label: DEBUG-END
+    action: comment
+    match: ['log\.']
+server:
+  listen: ["127.0.0.1:2022", "unix:/run/tgcom.sock"]
+  host-key: /etc/tgcom/hostkey
+  authorized-keys: /etc/tgcom/authorized_keys
+remote:
+  port: 2022
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := Load(path)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	profile, err := conf.Profile("generated")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if len(profile.Files) != 1 || profile.Files[0] != "gen/*.go" {
+		t.Errorf("unexpected files %v", profile.Files)
+	}
+
+	applied := profile.Apply(modfile.Config{Action: "toggle", DryRun: true})
+	if applied.StartLabel != "DEBUG-START" || applied.EndLabel != "DEBUG-END" || applied.Action != "comment" || !applied.DryRun || applied.Match[0] != `log\.` {
+		t.Errorf("unexpected config %+v", applied)
+	}
+
+	if len(conf.Server.Listen) != 2 || conf.Server.HostKey != "/etc/tgcom/hostkey" || conf.Server.AuthorizedKeys != "/etc/tgcom/authorized_keys" || conf.Remote.Port != 2022 {
+		t.Errorf("unexpected server settings %+v, %+v", conf.Server, conf.Remote)
+	}
+
+	if _, err := conf.Profile("missing"); err == nil {
+		t.Errorf("expected an error for an unknown profile")
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	content := "profiles:\n  generated:\n    start-lable: DEBUG-START\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "start-lable") {
+		t.Errorf("expected an error naming the misspelled key, got %v", err)
+	}
+
+	// An empty file has nothing to misspell
+	empty := filepath.Join(dir, "empty.yaml")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(empty); err != nil {
+		t.Errorf("No error expected got: %s", err)
+	}
+}
+
+func TestLoadDefault(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	userFile := UserFile
+	UserFile = filepath.Join(t.TempDir(), "config.yaml")
+	defer func() { UserFile = userFile }()
+
+	if _, err := Load(""); !errors.Is(err, ErrNoConfig) {
+		t.Errorf("expected ErrNoConfig, got %v", err)
+	}
+	if err := os.WriteFile(LocalFile, []byte("profiles:\n  a:\n    line: '3'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := Load("")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if conf.Profiles["a"].Line != "3" {
+		t.Errorf("unexpected profiles %v", conf.Profiles)
+	}
+}
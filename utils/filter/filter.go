@@ -0,0 +1,186 @@
+// Package filter implements a git clean and smudge filter driver, so that
+// selected sections are committed commented out but checked out
+// uncommented. Process speaks the long-running filter process protocol,
+// which lets git run a single tgcom for all the files of a command.
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+// Clean returns content with every line selected by conf commented out
+// once more, so that Smudge gives back comments that were already in the
+// section. Blank lines are left alone. name tells the language of content.
+// Binary content and content of unknown languages is returned unchanged.
+func Clean(content []byte, name string, conf modfile.Config) ([]byte, error) {
+	conf.Filename = name
+	lines, err := modfile.Selected(bytes.NewReader(content), conf)
+	if err != nil || len(lines) == 0 {
+		return passThrough(content, err)
+	}
+	conf.Action = "comment"
+	conf.Ranges = make([][2]int, len(lines))
+	for i, line := range lines {
+		conf.Ranges[i] = [2]int{line, line}
+	}
+	return change(content, conf)
+}
+
+// Smudge returns content with one comment level removed from the lines
+// selected by conf, undoing Clean. name tells the language of content.
+// Binary content and content of unknown languages is returned unchanged.
+func Smudge(content []byte, name string, conf modfile.Config) ([]byte, error) {
+	conf.Filename = name
+	conf.Action = "uncomment"
+	return change(content, conf)
+}
+
+// change applies conf to content. Lines that are not modified are returned
+// byte for byte, so that git does not see changes where there are none.
+func change(content []byte, conf modfile.Config) ([]byte, error) {
+	var out bytes.Buffer
+	if err := modfile.Change(bytes.NewReader(content), &out, conf); err != nil {
+		return passThrough(content, err)
+	}
+	result := out.Bytes()
+	if !bytes.HasSuffix(content, []byte("\n")) {
+		// Change ends the last line
+		result = bytes.TrimSuffix(result, []byte("\n"))
+	}
+	if bytes.Equal(result, content) {
+		return content, nil
+	}
+	return result, nil
+}
+
+// passThrough returns content when err tells that it cannot be filtered.
+func passThrough(content []byte, err error) ([]byte, error) {
+	if err == nil || errors.Is(err, modfile.ErrBinaryFile) || errors.Is(err, modfile.ErrUnsupportedExtension) {
+		return content, nil
+	}
+	return nil, err
+}
+
+// Process serves the requests of git's long-running filter process
+// protocol read from r, writing the responses to w, until r is closed.
+// Files that cannot be filtered make git fail when the filter is required,
+// and are logged to logger.
+func Process(r io.Reader, w io.Writer, conf modfile.Config, logger *log.Logger) error {
+	in := bufio.NewReader(r)
+	out := bufio.NewWriter(w)
+	if err := handshake(in, out); err != nil {
+		return fmt.Errorf("filter handshake failed: %w", err)
+	}
+
+	for {
+		header, err := readText(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content, err := readContent(in)
+		if err != nil {
+			return err
+		}
+
+		var command, pathname string
+		for _, line := range header {
+			key, value, _ := strings.Cut(line, "=")
+			switch key {
+			case "command":
+				command = value
+			case "pathname":
+				pathname = value
+			}
+		}
+
+		var result []byte
+		switch command {
+		case "clean":
+			result, err = Clean(content, pathname, conf)
+		case "smudge":
+			result, err = Smudge(content, pathname, conf)
+		default:
+			err = fmt.Errorf("unsupported command %q", command)
+		}
+		if err != nil {
+			logger.Printf("%s: %v", pathname, err)
+			err = writeText(out, "status=error")
+		} else {
+			err = respond(out, result)
+		}
+		if err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// handshake agrees on version 2 of the protocol and on the clean and smudge
+// capabilities.
+func handshake(in *bufio.Reader, out *bufio.Writer) error {
+	welcome, err := readText(in)
+	if err != nil {
+		return err
+	}
+	if len(welcome) == 0 || welcome[0] != "git-filter-client" {
+		return fmt.Errorf("unexpected welcome %q", welcome)
+	}
+	if !contains(welcome[1:], "version=2") {
+		return errors.New("git does not support version 2 of the protocol")
+	}
+	if err := writeText(out, "git-filter-server", "version=2"); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	capabilities, err := readText(in)
+	if err != nil {
+		return err
+	}
+	var supported []string
+	for _, capability := range []string{"capability=clean", "capability=smudge"} {
+		if contains(capabilities, capability) {
+			supported = append(supported, capability)
+		}
+	}
+	if err := writeText(out, supported...); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// respond writes a successful response with content. The empty list after
+// the content keeps the status.
+func respond(out *bufio.Writer, content []byte) error {
+	if err := writeText(out, "status=success"); err != nil {
+		return err
+	}
+	if err := writeContent(out, content); err != nil {
+		return err
+	}
+	return writeText(out)
+}
+
+func contains(lines []string, s string) bool {
+	for _, line := range lines {
+		if line == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+var labels = modfile.Config{StartLabel: "DEBUG-START", EndLabel: "DEBUG-END"}
+
+func TestPktLine(t *testing.T) {
+	var buf bytes.Buffer
+	content := bytes.Repeat([]byte("x"), maxPayload+10)
+	if err := writeText(&buf, "command=clean", "pathname=a.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeContent(&buf, content); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "0012command=clean\n0012pathname=a.go\n0000") {
+		t.Errorf("unexpected packets %q", buf.String()[:40])
+	}
+
+	r := bufio.NewReader(&buf)
+	lines, err := readText(r)
+	if err != nil || !reflect.DeepEqual(lines, []string{"command=clean", "pathname=a.go"}) {
+		t.Errorf("unexpected text %q, %v", lines, err)
+	}
+	got, err := readContent(r)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("content of %d bytes read as %d bytes, %v", len(content), len(got), err)
+	}
+
+	if _, err := readPacket(bufio.NewReader(strings.NewReader("0002"))); err == nil {
+		t.Errorf("expected an error for an invalid length")
+	}
+}
+
+func TestCleanSmudge(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		smudged string
+		cleaned string
+	}{
+		{
+			name:    "Labels",
+			file:    "main.go",
+			smudged: "package main\n// DEBUG-START\nprintln(1)\n// note\n\n// DEBUG-END\n",
+			cleaned: "package main\n// DEBUG-START\n// println(1)\n// // note\n\n// DEBUG-END\n",
+		},
+		{
+			name:    "LineEndings",
+			file:    "main.py",
+			smudged: "# DEBUG-START\r\nprint(1)\r\n# DEBUG-END",
+			cleaned: "# DEBUG-START\r\n# print(1)\r\n# DEBUG-END",
+		},
+		{
+			name:    "UnknownLanguage",
+			file:    "notes",
+			smudged: "DEBUG-START\nx\nDEBUG-END\n",
+			cleaned: "DEBUG-START\nx\nDEBUG-END\n",
+		},
+		{
+			name:    "Binary",
+			file:    "data.go",
+			smudged: "DEBUG-START\x00\nDEBUG-END",
+			cleaned: "DEBUG-START\x00\nDEBUG-END",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaned, err := Clean([]byte(tt.smudged), tt.file, labels)
+			if err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+			if string(cleaned) != tt.cleaned {
+				t.Errorf("expected cleaned %q, got %q", tt.cleaned, cleaned)
+			}
+			// Smudging gives back the content, comments included
+			smudged, err := Smudge(cleaned, tt.file, labels)
+			if err != nil || !bytes.Equal(smudged, []byte(tt.smudged)) {
+				t.Errorf("expected smudged %q, got %q, %v", tt.smudged, smudged, err)
+			}
+		})
+	}
+}
+
+// TestHelperProcess is the filter process run by git in TestProcess.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("TGCOM_WANT_FILTER_PROCESS") != "1" {
+		return
+	}
+	if err := Process(os.Stdin, os.Stdout, labels, log.New(os.Stderr, "", 0)); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+func TestProcess(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("TGCOM_WANT_FILTER_PROCESS", "1")
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+		return string(out)
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "-q")
+	git("config", "filter.tgcom.process", os.Args[0]+" -test.run=^TestHelperProcess$")
+	git("config", "filter.tgcom.required", "true")
+	write(".gitattributes", "*.go filter=tgcom\n")
+	working := "package main\n\nfunc main() {\n\t// DEBUG-START\n\tprintln(1)\n\t// DEBUG-END\n}\n"
+	write("main.go", working)
+	git("add", ".")
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial")
+
+	committed := "package main\n\nfunc main() {\n\t// DEBUG-START\n// \tprintln(1)\n\t// DEBUG-END\n}\n"
+	if blob := git("show", "HEAD:main.go"); blob != committed {
+		t.Errorf("expected committed %q, got %q", committed, blob)
+	}
+	if status := git("status", "--porcelain"); status != "" {
+		t.Errorf("expected a clean working tree, got %q", status)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "main.go")); err != nil {
+		t.Fatal(err)
+	}
+	git("checkout", "main.go")
+	if content, _ := os.ReadFile(filepath.Join(dir, "main.go")); string(content) != working {
+		t.Errorf("expected checked out %q, got %q", working, content)
+	}
+}
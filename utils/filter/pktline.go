@@ -0,0 +1,109 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxPayload is the largest payload of a pkt-line.
+const maxPayload = 65516
+
+// errFlush is returned by readPacket for a flush packet.
+var errFlush = errors.New("flush packet")
+
+// readPacket reads one pkt-line: four hexadecimal digits giving the length
+// of the packet, header included, then the payload. "0000" is a flush
+// packet.
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", header)
+	}
+	if length == 0 {
+		return nil, errFlush
+	}
+	if length < 4 || length-4 > maxPayload {
+		return nil, fmt.Errorf("invalid pkt-line length %d", length)
+	}
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// writePacket writes payload, which must not be longer than maxPayload, as
+// one pkt-line.
+func writePacket(w io.Writer, payload []byte) error {
+	if _, err := fmt.Fprintf(w, "%04x", len(payload)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func writeFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// readText reads text packets up to a flush packet, without their line
+// feeds.
+func readText(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		payload, err := readPacket(r)
+		if err == errFlush {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.TrimSuffix(string(payload), "\n"))
+	}
+}
+
+// writeText writes lines as text packets followed by a flush packet.
+func writeText(w io.Writer, lines ...string) error {
+	for _, line := range lines {
+		if err := writePacket(w, []byte(line+"\n")); err != nil {
+			return err
+		}
+	}
+	return writeFlush(w)
+}
+
+// readContent reads binary packets up to a flush packet.
+func readContent(r *bufio.Reader) ([]byte, error) {
+	var content []byte
+	for {
+		payload, err := readPacket(r)
+		if err == errFlush {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, payload...)
+	}
+}
+
+// writeContent writes content split in packets followed by a flush packet.
+func writeContent(w io.Writer, content []byte) error {
+	for len(content) > 0 {
+		n := min(len(content), maxPayload)
+		if err := writePacket(w, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return writeFlush(w)
+}
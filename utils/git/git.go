@@ -0,0 +1,429 @@
+// Package git runs the local git command to find changed lines and to read
+// and write file content in repositories. It never contacts a remote.
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrNotRepository is returned for files outside a git working tree.
+var ErrNotRepository = errors.New("not inside a git repository")
+
+// hunkHeader matches the header of a hunk of a unified diff.
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// Hunk is a changed region of a file: Old lines starting at OldStart were
+// replaced by New lines starting at NewStart.
+type Hunk struct {
+	OldStart, Old int
+	NewStart, New int
+}
+
+// run executes git in dir and returns its standard output. The standard
+// error of git is included in the returned error.
+func run(dir string, args ...string) ([]byte, error) {
+	return runInput(dir, nil, args...)
+}
+
+// runInput executes git in dir with input as its standard input.
+func runInput(dir string, input []byte, args ...string) ([]byte, error) {
+	return runEnv(dir, nil, input, args...)
+}
+
+// runEnv executes git in dir with env added to its environment.
+func runEnv(dir string, env []string, input []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// Toplevel returns the root of the working tree containing path.
+func Toplevel(path string) (string, error) {
+	dir := path
+	if !isDir(path) {
+		dir = filepath.Dir(path)
+	}
+	out, err := run(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrNotRepository, path)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ChangedLines returns the 1-based ranges of lines of filename, as it is in
+// the working tree, that differ from revision rev, or from the index if rev
+// is empty. With staged set the changes staged in the index are used
+// instead of rev, and mapped onto the lines of the working tree; staged
+// lines that were changed again since are left out. An untracked file is
+// changed as a whole.
+func ChangedLines(filename, rev string, staged bool) ([][2]int, error) {
+	if _, err := Toplevel(filename); err != nil {
+		return nil, err
+	}
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	if _, err := run(dir, "ls-files", "--error-unmatch", "--", base); err != nil {
+		return [][2]int{{1, math.MaxInt}}, nil
+	}
+
+	var hunks []Hunk
+	switch {
+	case staged:
+		tree, err := headTree(dir)
+		if err != nil {
+			return nil, err
+		}
+		hunks, err = diff(dir, "diff-index", "--cached", "--end-of-options", tree, "--", base)
+		if err != nil {
+			return nil, err
+		}
+	case rev != "":
+		commit, err := resolveCommit(dir, rev)
+		if err != nil {
+			return nil, err
+		}
+		hunks, err = diff(dir, "diff-index", "--end-of-options", commit, "--", base)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		if hunks, err = diff(dir, "diff-files", "--", base); err != nil {
+			return nil, err
+		}
+	}
+	ranges := Ranges(hunks)
+	if !staged {
+		return ranges, nil
+	}
+
+	unstaged, err := diff(dir, "diff-files", "--", base)
+	if err != nil {
+		return nil, err
+	}
+	return MapRanges(ranges, unstaged), nil
+}
+
+// diff runs command, the diff-index or diff-files plumbing of git diff, with
+// args and returns the hunks of its patch. Unlike git diff, they never
+// write the index.
+func diff(dir, command string, args ...string) ([]Hunk, error) {
+	args = append([]string{command, "-p", "--no-color", "--no-ext-diff", "--unified=0"}, args...)
+	out, err := run(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHunks(out)
+}
+
+// ParseHunks returns the hunks of a unified diff of a single file.
+func ParseHunks(diff []byte) ([]Hunk, error) {
+	var hunks []Hunk
+	for _, line := range strings.Split(string(diff), "\n") {
+		m := hunkHeader.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		var h Hunk
+		var err error
+		if h.OldStart, h.Old, err = hunkRange(m[1], m[2]); err != nil {
+			return nil, err
+		}
+		if h.NewStart, h.New, err = hunkRange(m[3], m[4]); err != nil {
+			return nil, err
+		}
+		hunks = append(hunks, h)
+	}
+	return hunks, nil
+}
+
+func hunkRange(start, count string) (int, int, error) {
+	s, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid hunk header: %w", err)
+	}
+	if count == "" {
+		return s, 1, nil
+	}
+	c, err := strconv.Atoi(count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid hunk header: %w", err)
+	}
+	return s, c, nil
+}
+
+// Ranges returns the new lines of hunks as 1-based ranges. Hunks that only
+// remove lines have no new lines and are left out.
+func Ranges(hunks []Hunk) [][2]int {
+	ranges := [][2]int{}
+	for _, h := range hunks {
+		if h.New > 0 {
+			ranges = append(ranges, [2]int{h.NewStart, h.NewStart + h.New - 1})
+		}
+	}
+	return ranges
+}
+
+// MapRanges moves ranges of lines of the old side of hunks to where they
+// are on the new side. Lines changed by hunks no longer exist and are
+// dropped.
+func MapRanges(ranges [][2]int, hunks []Hunk) [][2]int {
+	mapped := [][2]int{}
+	for _, r := range ranges {
+		extend := false
+		for line := r[0]; line <= r[1]; line++ {
+			n, ok := mapLine(line, hunks)
+			if !ok {
+				extend = false
+				continue
+			}
+			if extend && n == mapped[len(mapped)-1][1]+1 {
+				mapped[len(mapped)-1][1] = n
+			} else {
+				mapped = append(mapped, [2]int{n, n})
+			}
+			extend = true
+		}
+	}
+	return mapped
+}
+
+// mapLine returns the new number of old line n, or false if hunks change it.
+func mapLine(n int, hunks []Hunk) (int, bool) {
+	offset := 0
+	for _, h := range hunks {
+		// A hunk that only adds lines starts after line OldStart
+		first := h.OldStart
+		if h.Old == 0 {
+			first++
+		}
+		if n < first {
+			break
+		}
+		if n < first+h.Old {
+			return 0, false
+		}
+		offset += h.New - h.Old
+	}
+	return n + offset, true
+}
+
+// StagedFiles returns the files added, copied, modified or renamed in the
+// index of the repository at top, relative to top.
+func StagedFiles(top string) ([]string, error) {
+	out, err := run(top, "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, file := range strings.Split(string(out), "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// Show returns the content of the blob named by object, such as ":path" for
+// the staged content of path or "rev:path" for its content at rev.
+func Show(dir, object string) ([]byte, error) {
+	return run(dir, "cat-file", "--end-of-options", "blob", object)
+}
+
+// Stage replaces the staged content of path, relative to top, with content
+// and keeps its file mode.
+func Stage(top, path string, content []byte) error {
+	out, err := run(top, "ls-files", "--stage", "--", path)
+	if err != nil {
+		return err
+	}
+	mode, _, ok := strings.Cut(string(out), " ")
+	if !ok {
+		return fmt.Errorf("%s is not staged", path)
+	}
+	blob, err := hashObject(top, content)
+	if err != nil {
+		return err
+	}
+	_, err = run(top, "update-index", "--cacheinfo", mode+","+blob+","+path)
+	return err
+}
+
+// ShowFile returns the content of filename at revision rev, or in the index
+// if rev is ":".
+func ShowFile(rev, filename string) ([]byte, error) {
+	if _, err := Toplevel(filename); err != nil {
+		return nil, err
+	}
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	object := ":./" + base
+	if rev != ":" {
+		commit, err := resolveCommit(dir, rev)
+		if err != nil {
+			return nil, err
+		}
+		object = commit + object
+	}
+	return Show(dir, object)
+}
+
+// CommitFile creates a commit on top of revision rev in which filename has
+// content, and returns its id. Neither the working tree, the index nor any
+// branch is changed: the commit is only reachable through its id.
+func CommitFile(rev, filename string, content []byte, message string) (string, error) {
+	top, err := Toplevel(filename)
+	if err != nil {
+		return "", err
+	}
+	path, err := repoPath(top, filename)
+	if err != nil {
+		return "", err
+	}
+	parent, err := resolveCommit(top, rev)
+	if err != nil {
+		return "", err
+	}
+
+	// Build the tree in a temporary index, so that the real one is untouched
+	index, err := os.CreateTemp("", "tgcom-index-*")
+	if err != nil {
+		return "", err
+	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+	env := []string{"GIT_INDEX_FILE=" + index.Name()}
+
+	if _, err := runEnv(top, env, nil, "read-tree", parent); err != nil {
+		return "", err
+	}
+	mode := "100644"
+	if out, err := run(top, "ls-tree", parent, "--", path); err == nil {
+		if fields := strings.Fields(string(out)); len(fields) > 0 {
+			mode = fields[0]
+		}
+	}
+	blob, err := hashObject(top, content)
+	if err != nil {
+		return "", err
+	}
+	if _, err := runEnv(top, env, nil, "update-index", "--add", "--cacheinfo", mode+","+blob+","+path); err != nil {
+		return "", err
+	}
+	tree, err := runEnv(top, env, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	commit, err := runInput(top, []byte(message), "commit-tree", strings.TrimSpace(string(tree)), "-p", parent)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// resolveCommit returns the id of the commit named by rev. Revisions
+// starting with - are refused, so that git never takes them as options.
+func resolveCommit(dir, rev string) (string, error) {
+	if strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("invalid revision %s: it cannot start with -", rev)
+	}
+	out, err := run(dir, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%s is not a commit", rev)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// headTree returns the commit HEAD points to, or the empty tree before the
+// first commit.
+func headTree(dir string) (string, error) {
+	if commit, err := resolveCommit(dir, "HEAD"); err == nil {
+		return commit, nil
+	}
+	out, err := runInput(dir, []byte{}, "hash-object", "-t", "tree", "--stdin")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// hashObject writes content to the object database and returns its id.
+func hashObject(dir string, content []byte) (string, error) {
+	out, err := runInput(dir, content, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// repoPath returns the path of filename relative to top, with slashes.
+func repoPath(top, filename string) (string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	// Resolve symlinks in the directories, as git does for top
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(dir, filepath.Base(abs))
+	}
+	if resolved, err := filepath.EvalSymlinks(top); err == nil {
+		top = resolved
+	}
+	rel, err := filepath.Rel(top, abs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// HooksDir returns the directory git runs the hooks of the repository
+// containing dir from, honouring core.hooksPath.
+func HooksDir(dir string) (string, error) {
+	top, err := Toplevel(dir)
+	if err != nil {
+		return "", err
+	}
+	out, err := run(top, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+	hooks := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(hooks) {
+		hooks = filepath.Join(top, hooks)
+	}
+	return hooks, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
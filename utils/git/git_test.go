@@ -0,0 +1,189 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// initRepo creates a repository in a temporary directory with file
+// committed with content.
+func initRepo(t *testing.T, file, content string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, file)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", file},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		if _, err := run(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestParseHunks(t *testing.T) {
+	diff := "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -2 +2 @@ func\n-a\n+b\n@@ -5,0 +6,2 @@\n+c\n+d\n@@ -9,2 +10,0 @@\n-e\n-f\n"
+	hunks, err := ParseHunks([]byte(diff))
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	expected := []Hunk{{2, 1, 2, 1}, {5, 0, 6, 2}, {9, 2, 10, 0}}
+	if !reflect.DeepEqual(hunks, expected) {
+		t.Errorf("expected %v, got %v", expected, hunks)
+	}
+	if ranges := Ranges(hunks); !reflect.DeepEqual(ranges, [][2]int{{2, 2}, {6, 7}}) {
+		t.Errorf("unexpected ranges %v", ranges)
+	}
+}
+
+func TestMapRanges(t *testing.T) {
+	// Line 3 was replaced and two lines were added after line 5
+	hunks := []Hunk{{3, 1, 3, 1}, {5, 0, 6, 2}}
+	mapped := MapRanges([][2]int{{2, 7}}, hunks)
+	expected := [][2]int{{2, 2}, {4, 5}, {8, 9}}
+	if !reflect.DeepEqual(mapped, expected) {
+		t.Errorf("expected %v, got %v", expected, mapped)
+	}
+}
+
+func TestChangedLines(t *testing.T) {
+	path := initRepo(t, "main.go", "a\nb\nc\nd\n")
+
+	if err := os.WriteFile(path, []byte("a\nB\nc\nd\ne\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := ChangedLines(path, "HEAD", false)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if !reflect.DeepEqual(ranges, [][2]int{{2, 2}, {5, 5}}) {
+		t.Errorf("unexpected ranges %v", ranges)
+	}
+
+	// Stage the change, then insert a line above it in the working tree
+	if _, err := run(filepath.Dir(path), "add", "main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("new\na\nB\nc\nd\ne\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err = ChangedLines(path, "", true)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if !reflect.DeepEqual(ranges, [][2]int{{3, 3}, {6, 6}}) {
+		t.Errorf("unexpected staged ranges %v", ranges)
+	}
+
+	untracked := filepath.Join(filepath.Dir(path), "new.go")
+	if err := os.WriteFile(untracked, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err = ChangedLines(untracked, "HEAD", false)
+	if err != nil || len(ranges) != 1 || ranges[0][0] != 1 {
+		t.Errorf("expected an untracked file to be changed as a whole, got %v, %v", ranges, err)
+	}
+}
+
+func TestChangedLinesOutsideRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ChangedLines(path, "HEAD", false); !errors.Is(err, ErrNotRepository) {
+		t.Errorf("expected ErrNotRepository, got %v", err)
+	}
+}
+
+func TestShowFileAndCommitFile(t *testing.T) {
+	path := initRepo(t, "config.go", "a\nb\n")
+	if err := os.WriteFile(path, []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ShowFile("HEAD", path)
+	if err != nil || string(content) != "a\nb\n" {
+		t.Errorf("unexpected content %q, %v", content, err)
+	}
+	if _, err := ShowFile("HEAD", filepath.Join(filepath.Dir(path), "missing.go")); err == nil {
+		t.Errorf("expected an error for a file missing at HEAD")
+	}
+
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	commit, err := CommitFile("HEAD", path, []byte("// a\nb\n"), "variant")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	content, err = ShowFile(commit, path)
+	if err != nil || string(content) != "// a\nb\n" {
+		t.Errorf("unexpected committed content %q, %v", content, err)
+	}
+
+	// The working tree and the index are left alone
+	if content, _ := os.ReadFile(path); string(content) != "changed\n" {
+		t.Errorf("the working tree was modified: %q", content)
+	}
+	if content, _ := ShowFile(":", path); string(content) != "a\nb\n" {
+		t.Errorf("the index was modified: %q", content)
+	}
+}
+
+func TestDashRevision(t *testing.T) {
+	path := initRepo(t, "main.go", "a\n")
+	output := filepath.Join(t.TempDir(), "output")
+	rev := "--output=" + output
+
+	if _, err := ChangedLines(path, rev, false); err == nil {
+		t.Errorf("expected an error for the revision %s", rev)
+	}
+	if _, err := ShowFile(rev, path); err == nil {
+		t.Errorf("expected an error for the revision %s", rev)
+	}
+	if _, err := CommitFile(rev, path, []byte("b\n"), "variant"); err == nil {
+		t.Errorf("expected an error for the revision %s", rev)
+	}
+	if _, err := os.Stat(output); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the revision not to be taken as an option, got %v", err)
+	}
+}
+
+func TestChangedLinesStagedBeforeFirstCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(path, []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "main.go"}} {
+		if _, err := run(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ranges, err := ChangedLines(path, "", true)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if !reflect.DeepEqual(ranges, [][2]int{{1, 2}}) {
+		t.Errorf("expected the staged file to be changed as a whole, got %v", ranges)
+	}
+}
@@ -0,0 +1,156 @@
+// Package hook implements the git pre-commit hook that stops commits which
+// leave labelled sections, such as debugging code, uncommented.
+package hook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dyne/tgcom/utils/git"
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+// Labels of the sections checked when none are given.
+const (
+	DefaultStartLabel = "DEBUG-START"
+	DefaultEndLabel   = "DEBUG-END"
+)
+
+// marker identifies hooks written by Install, which can be replaced safely.
+const marker = "# Installed by tgcom hook install"
+
+// Problem is a line of a staged file left uncommented in a labelled section.
+type Problem struct {
+	File  string // path relative to the root of the repository
+	Line  int
+	Fixed bool // the line was commented out and staged again
+}
+
+func (p Problem) String() string {
+	if p.Fixed {
+		return fmt.Sprintf("%s:%d: commented out", p.File, p.Line)
+	}
+	return fmt.Sprintf("%s:%d: uncommented line in labelled section", p.File, p.Line)
+}
+
+// Install writes a pre-commit hook running "tgcom hook run" with args to the
+// repository containing dir and returns its path. A hook that was not
+// installed by tgcom is only replaced when overwrite is set.
+func Install(dir string, args []string, overwrite bool) (string, error) {
+	hooks, err := git.HooksDir(dir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(hooks, "pre-commit")
+
+	existing, err := os.ReadFile(path)
+	if err == nil && !bytes.Contains(existing, []byte(marker)) && !overwrite {
+		return "", fmt.Errorf("a pre-commit hook already exists: %s", path)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	script := fmt.Sprintf("#!/bin/sh\n%s\nexec tgcom hook run %s\n", marker, strings.Join(quoted, " "))
+
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of an existing file
+	return path, os.Chmod(path, 0755)
+}
+
+// Check returns the lines between the labels of conf that are left
+// uncommented in the staged content of the repository containing dir. The
+// working tree is not read. With fix set the lines are commented out in the
+// index, and in the working tree as well when the file there has no
+// unstaged changes. Binary files and files of unknown languages are skipped.
+func Check(dir string, conf modfile.Config, fix bool) ([]Problem, error) {
+	top, err := git.Toplevel(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := git.StagedFiles(top)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, file := range files {
+		staged, err := git.Show(top, ":"+file)
+		if err != nil {
+			return nil, err
+		}
+		fileConf := conf
+		fileConf.Filename = file
+		lines, err := modfile.Uncommented(bytes.NewReader(staged), fileConf)
+		if errors.Is(err, modfile.ErrBinaryFile) || errors.Is(err, modfile.ErrUnsupportedExtension) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		if fix {
+			if err := fixFile(top, file, staged, fileConf, lines); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+		}
+		for _, line := range lines {
+			problems = append(problems, Problem{File: file, Line: line, Fixed: fix})
+		}
+	}
+	return problems, nil
+}
+
+// fixFile comments out lines of the staged content of file and stages the
+// result. The working tree file is rewritten too if it matches staged.
+func fixFile(top, file string, staged []byte, conf modfile.Config, lines []int) error {
+	conf.StartLabel, conf.EndLabel = "", ""
+	conf.Action = "comment"
+	conf.Ranges = make([][2]int, len(lines))
+	for i, line := range lines {
+		conf.Ranges[i] = [2]int{line, line}
+	}
+
+	var out bytes.Buffer
+	if err := modfile.Change(bytes.NewReader(staged), &out, conf); err != nil {
+		return err
+	}
+	if err := git.Stage(top, file, out.Bytes()); err != nil {
+		return err
+	}
+
+	path := filepath.Join(top, file)
+	snapshot, err := modfile.TakeSnapshot(path)
+	if err != nil {
+		// The file was removed from the working tree
+		return nil
+	}
+	current, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(current, staged) {
+		// Leave unstaged changes alone
+		return nil
+	}
+	conf.Filename = path
+	conf.Expect = &snapshot
+	return modfile.ChangeFile(conf)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
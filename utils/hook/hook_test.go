@@ -0,0 +1,109 @@
+package hook
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+// initRepo creates a repository in a temporary directory with files staged.
+func initRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q")
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gitCmd(t, dir, "add", name)
+	}
+	return dir
+}
+
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s", args[0], out)
+	}
+	return string(out)
+}
+
+func TestCheck(t *testing.T) {
+	dir := initRepo(t, map[string]string{
+		"main.go":  "package main\n// DEBUG-START\n// println(1)\nprintln(2)\n\n// DEBUG-END\n",
+		"clean.py": "# DEBUG-START\n# print(1)\n# DEBUG-END\n",
+		"data.bin": "\x00\x01",
+		"notes":    "DEBUG-START\nx\nDEBUG-END\n",
+	})
+	conf := modfile.Config{StartLabel: DefaultStartLabel, EndLabel: DefaultEndLabel}
+
+	// Only the staged content is checked
+	if err := os.WriteFile(filepath.Join(dir, "clean.py"), []byte("# DEBUG-START\nprint(1)\n# DEBUG-END\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Check(dir, conf, false)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if len(problems) != 1 || problems[0].String() != "main.go:4: uncommented line in labelled section" {
+		t.Errorf("unexpected problems %v", problems)
+	}
+
+	problems, err = Check(dir, conf, true)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if len(problems) != 1 || !problems[0].Fixed {
+		t.Errorf("expected the problem to be fixed, got %v", problems)
+	}
+	expected := "package main\n// DEBUG-START\n// println(1)\n// println(2)\n\n// DEBUG-END\n"
+	if staged := gitCmd(t, dir, "show", ":main.go"); staged != expected {
+		t.Errorf("unexpected staged content %q", staged)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "main.go")); string(content) != expected {
+		t.Errorf("unexpected working tree content %q", content)
+	}
+
+	problems, err = Check(dir, conf, false)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("expected no problems after fixing, got %v, %v", problems, err)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir := initRepo(t, nil)
+	path, err := Install(dir, []string{"-s", "it's"}, false)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	script, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(script), `exec tgcom hook run '-s' 'it'\''s'`) {
+		t.Errorf("unexpected hook %q", script)
+	}
+
+	// A hook installed by tgcom is replaced, any other is kept
+	if _, err := Install(dir, nil, false); err != nil {
+		t.Errorf("No error expected got: %s", err)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nmake lint\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Install(dir, nil, false); err == nil {
+		t.Errorf("expected an error for an existing hook")
+	}
+	if _, err := Install(dir, nil, true); err != nil {
+		t.Errorf("No error expected got: %s", err)
+	}
+}
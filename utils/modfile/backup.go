@@ -0,0 +1,154 @@
+package modfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Backup policies accepted by Config.Backup. They follow the GNU
+// --backup=CONTROL values used by cp, mv and install.
+const (
+	BackupNone     = "none"
+	BackupSimple   = "simple"
+	BackupNumbered = "numbered"
+	BackupExisting = "existing"
+)
+
+// DefaultBackupSuffix is appended to simple backups when Config.Suffix is empty.
+const DefaultBackupSuffix = "~"
+
+// normalizeBackupPolicy maps the GNU aliases onto the canonical policy names.
+func normalizeBackupPolicy(policy string) (string, error) {
+	switch strings.ToLower(policy) {
+	case "", "none", "off":
+		return BackupNone, nil
+	case "simple", "never":
+		return BackupSimple, nil
+	case "numbered", "t":
+		return BackupNumbered, nil
+	case "existing", "nil":
+		return BackupExisting, nil
+	default:
+		return "", fmt.Errorf("invalid backup policy %q. Please provide 'none', 'simple', 'numbered' or 'existing'", policy)
+	}
+}
+
+// backupName returns the path the backup of filename should be written to,
+// or an empty string when no backup is wanted. Backups in backupDir keep the
+// path of filename, so that files with the same name do not share backups.
+func backupName(filename, policy, backupDir, suffix string) (string, error) {
+	policy, err := normalizeBackupPolicy(policy)
+	if err != nil {
+		return "", err
+	}
+	if policy == BackupNone {
+		return "", nil
+	}
+	if suffix == "" {
+		suffix = DefaultBackupSuffix
+	}
+	if strings.ContainsRune(suffix, filepath.Separator) {
+		return "", fmt.Errorf("invalid backup suffix %q", suffix)
+	}
+
+	base := filename
+	if backupDir != "" {
+		if base, err = backupPath(filename, backupDir); err != nil {
+			return "", err
+		}
+	}
+
+	latest, err := latestNumberedBackup(base)
+	if err != nil {
+		return "", err
+	}
+	if policy == BackupNumbered || (policy == BackupExisting && latest > 0) {
+		return fmt.Sprintf("%s.~%d~", base, latest+1), nil
+	}
+	return base + suffix, nil
+}
+
+// backupPath returns the path of filename under backupDir: its path relative
+// to the working directory, or its absolute path, with the volume as a
+// directory, if it is outside of the working directory.
+func backupPath(filename, backupDir string) (string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		volume := filepath.VolumeName(abs)
+		rel = filepath.Join(strings.TrimSuffix(volume, ":"), abs[len(volume):])
+	}
+	return filepath.Join(backupDir, rel), nil
+}
+
+// latestNumberedBackup returns the highest N among existing base.~N~ files.
+func latestNumberedBackup(base string) (int, error) {
+	matches, err := filepath.Glob(escapeGlob(base) + ".~*~")
+	if err != nil {
+		return 0, err
+	}
+	latest := 0
+	prefix := base + ".~"
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(match, prefix), "~"))
+		if err == nil && n > latest {
+			latest = n
+		}
+	}
+	return latest, nil
+}
+
+// escapeGlob escapes the characters filepath.Match treats as special.
+func escapeGlob(path string) string {
+	replacer := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+	return replacer.Replace(path)
+}
+
+// createBackup copies filename to backupFilename. The copy is written to a
+// temporary file next to the backup and renamed into place, so a failed copy
+// never leaves a truncated backup behind.
+func createBackup(filename, backupFilename string) error {
+	inputFile, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	if err := os.MkdirAll(filepath.Dir(backupFilename), 0755); err != nil {
+		return err
+	}
+	backupFile, err := os.CreateTemp(filepath.Dir(backupFilename), "."+filepath.Base(backupFilename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(backupFile.Name())
+
+	if _, err = io.Copy(backupFile, inputFile); err != nil {
+		backupFile.Close()
+		return err
+	}
+	if err := backupFile.Sync(); err != nil {
+		backupFile.Close()
+		return err
+	}
+	if err := backupFile.Close(); err != nil {
+		return err
+	}
+	if info, err := inputFile.Stat(); err == nil {
+		if err := os.Chmod(backupFile.Name(), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return os.Rename(backupFile.Name(), backupFilename)
+}
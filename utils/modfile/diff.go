@@ -0,0 +1,83 @@
+package modfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultDiffContext is the number of unchanged lines shown around changes.
+const DefaultDiffContext = 3
+
+// Diff returns the unified diff of name from before to after, with context
+// unchanged lines around the changed ones, or "" if they are equal. Comments
+// are toggled in place, so lines are compared one to one; if the number of
+// lines differs, the whole content is shown as replaced.
+func Diff(name string, before, after []byte, context int) string {
+	if string(before) == string(after) {
+		return ""
+	}
+	oldLines, newLines := diffLines(before), diffLines(after)
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", name, name)
+	if len(oldLines) != len(newLines) {
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(0, len(oldLines)), hunkRange(0, len(newLines)))
+		writeLines(&b, "-", oldLines)
+		writeLines(&b, "+", newLines)
+		return b.String()
+	}
+
+	var changed []int
+	for i := range oldLines {
+		if oldLines[i] != newLines[i] {
+			changed = append(changed, i)
+		}
+	}
+	for i := 0; i < len(changed); {
+		// Changes separated by at most twice the context share a hunk
+		j := i
+		for j+1 < len(changed) && changed[j+1]-changed[j]-1 <= 2*context {
+			j++
+		}
+		start, end := max(changed[i]-context, 0), min(changed[j]+context+1, len(oldLines))
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(start, end-start), hunkRange(start, end-start))
+		for k := start; k < end; k++ {
+			if oldLines[k] == newLines[k] {
+				writeLines(&b, " ", oldLines[k:k+1])
+			} else {
+				writeLines(&b, "-", oldLines[k:k+1])
+				writeLines(&b, "+", newLines[k:k+1])
+			}
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// diffLines returns the lines of content with their line endings.
+func diffLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// hunkRange formats the range of count lines from start for a hunk header.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// writeLines writes lines to b, each after prefix.
+func writeLines(b *strings.Builder, prefix string, lines []string) {
+	for _, line := range lines {
+		b.WriteString(prefix)
+		b.WriteString(strings.TrimSuffix(line, "\n"))
+		b.WriteString("\n")
+		if !strings.HasSuffix(line, "\n") {
+			b.WriteString("\\ No newline at end of file\n")
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package modfile
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Encodings reported by DetectEncoding.
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF8BOM = "utf-8-bom"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin-1"
+	EncodingBinary  = "binary"
+)
+
+// sniffLen is how much of a file is inspected to guess its encoding.
+const sniffLen = 8000
+
+// ErrBinaryFile is returned when asked to edit a file that does not look
+// like text. Config.Force overrides the check.
+var ErrBinaryFile = errors.New("refusing to edit binary file")
+
+// DetectEncoding guesses the encoding of a file from its first bytes.
+// Byte order marks identify UTF-8 and UTF-16, NUL bytes or control
+// characters mark binary content, and anything else that is not valid
+// UTF-8 is assumed to be Latin-1.
+func DetectEncoding(sample []byte) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		return EncodingUTF8BOM
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return EncodingUTF16BE
+	}
+
+	for _, b := range sample {
+		if b < 0x20 && !isTextControl(b) {
+			return EncodingBinary
+		}
+	}
+
+	if utf8.Valid(trimPartialRune(sample)) {
+		return EncodingUTF8
+	}
+	return EncodingLatin1
+}
+
+// IsBinary reports whether filename looks like a binary file.
+func IsBinary(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return IsBinaryReader(file)
+}
+
+// IsBinaryReader reports whether the content read from r looks binary. Only
+// the first bytes are read.
+func IsBinaryReader(r io.Reader) (bool, error) {
+	sample := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return DetectEncoding(sample[:n]) == EncodingBinary, nil
+}
+
+// isTextControl reports whether the control character b is common in text files.
+func isTextControl(b byte) bool {
+	switch b {
+	case '\t', '\n', '\v', '\f', '\r', 0x1b:
+		return true
+	}
+	return false
+}
+
+// trimPartialRune drops an incomplete UTF-8 sequence cut off at the end of
+// the sample, so that it does not make a valid file look like Latin-1.
+func trimPartialRune(sample []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(sample); i++ {
+		if utf8.RuneStart(sample[len(sample)-i]) {
+			if !utf8.FullRune(sample[len(sample)-i:]) {
+				return sample[:len(sample)-i]
+			}
+			break
+		}
+	}
+	return sample
+}
+
+// textEncoding returns the encoding to transcode from and to, or nil when
+// the content can be processed as it is.
+func textEncoding(name string) encoding.Encoding {
+	switch name {
+	case EncodingUTF8BOM:
+		return unicode.UTF8BOM
+	case EncodingUTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	case EncodingUTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	case EncodingLatin1:
+		return charmap.ISO8859_1
+	}
+	return nil
+}
+
+// decodeInput sniffs the encoding of input and returns a reader producing
+// UTF-8, along with the encoding the output has to be converted back to.
+// Binary content is refused unless force is set, in which case it is
+// passed through untouched.
+func decodeInput(input io.Reader, force bool) (io.Reader, encoding.Encoding, error) {
+	reader := bufio.NewReaderSize(input, sniffLen)
+	sample, err := reader.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+
+	detected := DetectEncoding(sample)
+	if detected == EncodingBinary {
+		if !force {
+			return nil, nil, ErrBinaryFile
+		}
+		return reader, nil, nil
+	}
+
+	enc := textEncoding(detected)
+	if enc == nil {
+		return reader, nil, nil
+	}
+	return transform.NewReader(reader, enc.NewDecoder()), enc, nil
+}
+
+// nopWriteCloser turns an io.Writer into an io.WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encodeOutput wraps output so that UTF-8 written to it is converted to enc.
+// The returned writer must be closed to flush the conversion.
+func encodeOutput(output io.Writer, enc encoding.Encoding) io.WriteCloser {
+	if enc == nil {
+		return nopWriteCloser{output}
+	}
+	return transform.NewWriter(output, enc.NewEncoder())
+}
@@ -0,0 +1,149 @@
+package modfile
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// expandSelection returns the lines selected by sel in src, each with the
+// pattern that selected it, together with before and after lines of
+// context around them. With statements set, every selected line is then
+// extended to the complete statement or bracket group it belongs to, so
+// that commenting it does not leave half a call or an unbalanced block
+// behind. Lines added by the expansion have no pattern.
+func expandSelection(src []byte, sel selection, commentChars string, before, after int, statements bool) (map[int]string, error) {
+	expanded := make(map[int]string)
+	lineCount, err := scanSelection(bytes.NewReader(src), sel, commentChars, func(n int, _, _ string, selected, _ bool, pattern string) error {
+		if selected {
+			expanded[n] = pattern
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range sortedLines(expanded) {
+		for ctx := max(1, n-before); ctx <= min(lineCount, n+after); ctx++ {
+			if _, ok := expanded[ctx]; !ok {
+				expanded[ctx] = ""
+			}
+		}
+	}
+
+	if statements {
+		nesting := bracketNesting(uncommentedLines(src, commentChars), commentChars)
+		for _, n := range sortedLines(expanded) {
+			start, end := statementRange(nesting, n-1)
+			for stmt := start + 1; stmt <= end+1; stmt++ {
+				if _, ok := expanded[stmt]; !ok {
+					expanded[stmt] = ""
+				}
+			}
+		}
+	}
+	return expanded, nil
+}
+
+func sortedLines(lines map[int]string) []int {
+	sorted := make([]int, 0, len(lines))
+	for n := range lines {
+		sorted = append(sorted, n)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// splitLines splits src into lines the way the line scanner of
+// writeChanges does.
+func splitLines(src []byte) []string {
+	if len(src) == 0 {
+		return nil
+	}
+	lines := strings.Split(string(bytes.TrimSuffix(src, []byte("\n"))), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// nesting describes the brackets open at the start of a line.
+type nesting struct {
+	depth   int  // number of brackets open at the start of the line
+	lowest  int  // lowest number of open brackets within the line
+	inParen bool // the innermost open bracket is a parenthesis or square bracket
+}
+
+// bracketNesting returns the nesting of every line, plus one for the end of
+// the input. Brackets inside string literals and trailing comments are
+// ignored.
+func bracketNesting(lines []string, commentChars string) []nesting {
+	var stack []rune
+	result := make([]nesting, 0, len(lines)+1)
+	for _, line := range lines {
+		n := nesting{depth: len(stack), lowest: len(stack)}
+		n.inParen = len(stack) > 0 && stack[len(stack)-1] != '{'
+		for _, r := range stripComment(stripStrings(line), commentChars) {
+			switch r {
+			case '(', '[', '{':
+				stack = append(stack, r)
+			case ')', ']', '}':
+				if len(stack) > 0 {
+					stack = stack[:len(stack)-1]
+				}
+				n.lowest = min(n.lowest, len(stack))
+			}
+		}
+		result = append(result, n)
+	}
+	return append(result, nesting{depth: len(stack), lowest: len(stack)})
+}
+
+// stripComment removes a trailing line comment. The comment marker must
+// start the line or follow a blank, so that shell expressions such as
+// ${#list[@]} are left alone.
+func stripComment(line, commentChars string) string {
+	if commentChars == "" {
+		return line
+	}
+	for i := strings.Index(line, commentChars); i >= 0; {
+		if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+			return line[:i]
+		}
+		next := strings.Index(line[i+1:], commentChars)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return line
+}
+
+// statementRange returns the 0-based range of lines of the statement that
+// line belongs to. The range starts at the line that opened any parenthesis
+// the statement is continued in, ends where all the brackets it opens are
+// closed, and grows back to the opening line of any block it closes.
+func statementRange(lines []nesting, line int) (int, int) {
+	start, end := line, line
+	for {
+		for start > 0 && lines[start].inParen {
+			start--
+		}
+		base := lines[start].depth
+		for end+1 < len(lines)-1 && lines[end+1].depth > base {
+			end++
+		}
+
+		lowest := base
+		for i := start; i <= end; i++ {
+			lowest = min(lowest, lines[i].lowest)
+		}
+		if lowest >= base {
+			return start, end
+		}
+		for start > 0 && lines[start].depth > lowest {
+			start--
+		}
+	}
+}
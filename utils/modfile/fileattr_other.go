@@ -0,0 +1,10 @@
+//go:build !unix
+
+package modfile
+
+import "os"
+
+// copyOwner is a no-op on platforms without POSIX ownership.
+func copyOwner(info os.FileInfo, dst *os.File) error {
+	return nil
+}
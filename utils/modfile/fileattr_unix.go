@@ -0,0 +1,28 @@
+//go:build unix
+
+package modfile
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// copyOwner gives dst the owner and group recorded in info. Changing the
+// owner usually requires privileges, so a permission error is not fatal:
+// the file then keeps the owner of the user running tgcom.
+func copyOwner(info os.FileInfo, dst *os.File) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := dst.Chown(int(stat.Uid), int(stat.Gid))
+	if errors.Is(err, os.ErrPermission) {
+		// Try to at least keep the group, which the owner may change
+		err = dst.Chown(-1, int(stat.Gid))
+		if errors.Is(err, os.ErrPermission) {
+			return nil
+		}
+	}
+	return err
+}
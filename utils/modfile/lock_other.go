@@ -0,0 +1,15 @@
+//go:build !unix
+
+package modfile
+
+import "os"
+
+// LockFile is a no-op on platforms without flock.
+func LockFile(f *os.File) error {
+	return nil
+}
+
+// syncDir is a no-op on platforms where directories cannot be synced.
+func syncDir(dir string) error {
+	return nil
+}
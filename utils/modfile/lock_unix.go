@@ -0,0 +1,31 @@
+//go:build unix
+
+package modfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockFile takes an exclusive advisory lock on f, blocking until it is
+// available. The lock is released when f is closed.
+func LockFile(f *os.File) error {
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// syncDir flushes the directory entry changes of dir to disk, so that a
+// rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
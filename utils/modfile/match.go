@@ -0,0 +1,129 @@
+package modfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// Formats of the dry-run report accepted by Config.Format.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// report describes how a dry run prints the lines it would change.
+type report struct {
+	format   string // FormatText when empty
+	filename string // empty for stdin
+}
+
+// reportLine is a line of the JSON dry-run report.
+type reportLine struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line"`
+	Before  string `json:"before"`
+	After   string `json:"after"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+func newReport(filename, format string) (report, error) {
+	switch format {
+	case "", FormatText, FormatJSON:
+		return report{format: format, filename: filename}, nil
+	default:
+		return report{}, fmt.Errorf("invalid format %q. Please provide 'text' or 'json'", format)
+	}
+}
+
+// print writes one changed line. Text lines name the pattern that selected
+// them, if any, after the change.
+func (r report) print(w io.Writer, line int, before, after, pattern string) error {
+	if r.format == FormatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(reportLine{File: r.filename, Line: line, Before: before, After: after, Pattern: pattern})
+	}
+	var err error
+	if pattern != "" {
+		_, err = fmt.Fprintf(w, "%d: %s -> %s (match: %s)\n", line, before, after, pattern)
+	} else {
+		_, err = fmt.Fprintf(w, "%d: %s -> %s\n", line, before, after)
+	}
+	return err
+}
+
+// compilePatterns compiles the expressions given to --match or --not-match.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// selects reports whether a line is selected, and which of the match
+// patterns selected it. Patterns narrow down the line range or label
+// section when one is given, and select from the whole input otherwise.
+// Changed lines from git and Config.Ranges narrow down any other selection
+// in the same way. A line matching any not-match pattern is never selected.
+// Once the selection has been expanded, the expanded lines are selected
+// instead.
+func (s selection) selects(currentLine int, line string, inSection bool) (bool, string) {
+	if s.expanded != nil {
+		pattern, ok := s.expanded[currentLine]
+		return ok, pattern
+	}
+	if s.changed != nil && !inRanges(currentLine, s.changed) {
+		return false, ""
+	}
+	hasRange := s.lines[1] != 0 || s.startLabel != "" && s.endLabel != ""
+	if hasRange && !shouldProcessLine(currentLine, s.lines, s.startLabel, s.endLabel, inSection) {
+		return false, ""
+	}
+	if !hasRange && s.changed == nil && len(s.match) == 0 && len(s.notMatch) == 0 {
+		return false, ""
+	}
+	for _, re := range s.notMatch {
+		if re.MatchString(line) {
+			return false, ""
+		}
+	}
+	if len(s.match) == 0 {
+		return true, ""
+	}
+	for _, re := range s.match {
+		if re.MatchString(line) {
+			return true, re.String()
+		}
+	}
+	return false, ""
+}
+
+// intersectRanges returns the lines that are in both a and b, as ranges.
+func intersectRanges(a, b [][2]int) [][2]int {
+	ranges := [][2]int{}
+	for _, ra := range a {
+		for _, rb := range b {
+			start, end := max(ra[0], rb[0]), min(ra[1], rb[1])
+			if start <= end {
+				ranges = append(ranges, [2]int{start, end})
+			}
+		}
+	}
+	return ranges
+}
+
+func inRanges(line int, ranges [][2]int) bool {
+	for _, r := range ranges {
+		if r[0] <= line && line <= r[1] {
+			return true
+		}
+	}
+	return false
+}
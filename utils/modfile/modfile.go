@@ -2,26 +2,52 @@ package modfile
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/dyne/tgcom/utils/commenter"
+	"github.com/dyne/tgcom/utils/git"
+	"github.com/dyne/tgcom/utils/syntax"
 )
 
 // Config holds configuration settings for modifying files based on comments.
 type Config struct {
-	Filename   string
-	LineNum    string
-	StartLabel string
-	EndLabel   string
-	Lang       string
-	Action     string
-	DryRun     bool
+	Filename      string
+	StdinFilename string // Tells the language and names stdin in reports when Filename is "" or StdinName
+	LineNum       string
+	StartLabel    string
+	EndLabel      string
+	Lang          string
+	Action        string
+	DryRun        bool
+	Backup        string    // Backup policy: "none", "simple", "numbered" or "existing"
+	BackupDir     string    // Directory for backups, defaults to the directory of the file
+	Suffix        string    // Suffix for simple backups, defaults to DefaultBackupSuffix
+	NoFollow      bool      // Replace a symlink with the rewritten file instead of editing its target
+	Expect        *Snapshot // If set, the file must still match this snapshot to be rewritten
+	Original      *Snapshot // If set, receives the snapshot of the file taken under its lock before it is rewritten
+	Written       *Snapshot // If set, receives the snapshot of the content that replaced the file under its lock
+	Force         bool      // Edit the file even if it looks binary
+	Func          string    // Select the lines of the function with this name, or Type.Method
+	Type          string    // Select the lines of the type with this name
+	Block         string    // Select the block whose first line contains this text
+	Match         []string  // Select only lines matching one of these regular expressions
+	NotMatch      []string  // Never select lines matching one of these regular expressions
+	Format        string    // Format of the dry-run report: "text" or "json"
+	Before        int       // Also select this many lines before each selected line
+	After         int       // Also select this many lines after each selected line
+	Statement     bool      // Extend the selection to complete statements and bracket groups
+	GitDiff       string    // Select only lines changed since this git revision
+	Staged        bool      // Select only lines with changes staged in the git index
+	Unstaged      bool      // Select only lines with changes not staged in the git index
+	Ranges        [][2]int  // If not nil, select only lines in these ranges
 }
 
 func setModFunc(action string) (func(string, string) string, error) {
@@ -41,245 +67,577 @@ func setModFunc(action string) (func(string, string) string, error) {
 	}
 }
 
+// StdinName is the file name that stands for stdin, as in many filters.
+const StdinName = "-"
+
 // This function process the input
 func ChangeFile(conf Config) error {
-	var file *os.File
-	var err error
-	var isStdin bool
-
-	if conf.Filename == "" {
-		// Read from stdin
-		file = os.Stdin
-		isStdin = true
-	} else {
-		// Open the file
-		file, err = os.Open(conf.Filename)
+	if conf.Filename == "" || conf.Filename == StdinName {
+		// Read from stdin, named after StdinFilename if given
+		conf.Filename = conf.StdinFilename
+		return change(os.Stdin, os.Stdout, conf, true)
+	}
+
+	if conf.DryRun {
+		file, err := os.Open(conf.Filename)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
+		return Change(file, os.Stdout, conf)
 	}
 
-	char, err := selectCommentChars(conf.Filename, conf.Lang)
+	// Open the file, locking it as it is going to be rewritten. The lock is
+	// held until the rewritten file has replaced the original.
+	file, err := openLocked(conf.Filename)
 	if err != nil {
 		return err
 	}
-	modFunc, err := setModFunc(conf.Action)
+	defer file.Close()
+
+	ed, _, err := newEditor(conf, file, false)
+	if err != nil {
+		return err
+	}
+	return rewriteFile(file, conf, ed.sel, ed.char, ed.modFunc)
+}
+
+// Change modifies the lines of input selected by conf and writes the result
+// to output, or the report of the changes in a dry run. conf.Filename is not
+// opened: it only tells the language and names the input in errors and
+// reports.
+func Change(input io.Reader, output io.Writer, conf Config) error {
+	return change(input, output, conf, false)
+}
+
+// change is Change, with isStdin telling whether input is stdin rather than
+// the content of conf.Filename.
+func change(input io.Reader, output io.Writer, conf Config, isStdin bool) error {
+	ed, input, err := newEditor(conf, input, isStdin)
 	if err != nil {
 		return err
 	}
+	decoded, enc, err := decodeInput(input, conf.Force)
+	if err != nil {
+		return inputError(conf.Filename, err)
+	}
+
+	if conf.DryRun {
+		err = printChanges(decoded, output, ed.sel, ed.rep, ed.char, ed.modFunc)
+	} else {
+		encoded := encodeOutput(output, enc)
+		err = writeChanges(decoded, encoded, ed.sel, ed.char, ed.modFunc)
+		if err == nil {
+			err = encoded.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to process the file: %s", err)
+	}
+	return nil
+}
+
+// Uncommented returns the numbers of the lines of input selected by conf
+// that are neither blank nor commented out.
+func Uncommented(input io.Reader, conf Config) ([]int, error) {
+	return selectedLines(input, conf, true)
+}
+
+// Selected returns the numbers of the lines of input selected by conf that
+// are not blank, commented out or not.
+func Selected(input io.Reader, conf Config) ([]int, error) {
+	return selectedLines(input, conf, false)
+}
+
+// selectedLines returns the numbers of the lines of input selected by conf
+// that are not blank, and not commented out with uncommented set.
+func selectedLines(input io.Reader, conf Config, uncommented bool) ([]int, error) {
+	ed, input, err := newEditor(conf, input, false)
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := decodeInput(input, conf.Force)
+	if err != nil {
+		return nil, inputError(conf.Filename, err)
+	}
+
+	var lines []int
+	_, err = scanSelection(decoded, ed.sel, ed.char, func(n int, line, _ string, selected, _ bool, _ string) error {
+		if selected && strings.TrimSpace(line) != "" && !(uncommented && isCommented(line, ed.char)) {
+			lines = append(lines, n)
+		}
+		return nil
+	})
+	return lines, err
+}
+
+// editor holds what is needed to modify the lines selected by a Config.
+type editor struct {
+	char    string
+	modFunc func(string, string) string
+	sel     selection
+	rep     report
+	isStdin bool // input is stdin, even if named after a file
+}
+
+// newEditor resolves the selection of conf on input. Selections that look
+// at the whole content first, such as symbols and context, read input up
+// front; the returned reader then yields the same content again. isStdin
+// tells that input is stdin, whatever conf.Filename names it.
+func newEditor(conf Config, input io.Reader, isStdin bool) (*editor, io.Reader, error) {
+	lang, err := selectLanguage(conf.Filename, conf.Lang)
+	if err != nil {
+		return nil, nil, err
+	}
+	char := CommentChars[lang]
+	modFunc, err := setModFunc(conf.Action)
+	if err != nil {
+		return nil, nil, err
+	}
 	lines := [2]int{0, 0}
 	if conf.LineNum != "" {
 		lines, err = findLines(conf.LineNum)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
-	if conf.DryRun {
-		err := printChanges(file, lines, conf.StartLabel, conf.EndLabel, char, modFunc)
+
+	kind, name, err := symbolQuery(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conf.Before < 0 || conf.After < 0 {
+		return nil, nil, fmt.Errorf("context must not be negative")
+	}
+	expand := conf.Before > 0 || conf.After > 0 || conf.Statement
+	var src []byte
+	if kind != "" || expand {
+		// The source is read once to select the lines and once more to modify them
+		src, input, err = readSource(input, conf)
 		if err != nil {
-			return fmt.Errorf("failed to process the file: %s", err)
+			return nil, nil, err
 		}
-	} else {
-		if isStdin {
-			err := printOutput(file, lines, conf.StartLabel, conf.EndLabel, char, modFunc)
-			if err != nil {
-				return fmt.Errorf("failed to process the file: %s", err)
-			}
-		} else {
-			// Create a backup of the original file
-			backupFilename := conf.Filename + ".bak"
-			if err := createBackup(conf.Filename, backupFilename); err != nil {
-				return err
-			}
-
-			// Create a temporary file
-			tmpFilename := conf.Filename + ".tmp"
-			tmpFile, err := os.Create(tmpFilename)
-			if err != nil {
-				restoreBackup(conf.Filename, backupFilename)
-				return err
-			}
-			defer tmpFile.Close()
-
-			_, err = file.Seek(0, io.SeekStart)
-			if err != nil {
-				restoreBackup(conf.Filename, backupFilename)
-				tmpFile.Close()
-				os.Remove(tmpFilename)
-				return err
-			}
-
-			err = writeChanges(file, tmpFile, lines, conf.StartLabel, conf.EndLabel, char, modFunc)
-			if err != nil {
-				restoreBackup(conf.Filename, backupFilename)
-				tmpFile.Close()
-				os.Remove(tmpFilename)
-				return err
-			}
-
-			if err := file.Close(); err != nil {
-				restoreBackup(conf.Filename, backupFilename)
-				tmpFile.Close()
-				os.Remove(tmpFilename)
-				return err
-			}
-
-			// Close the temporary file before renaming
-			if err := tmpFile.Close(); err != nil {
-				os.Remove(tmpFilename)
-				return err
-			}
-
-			// Rename temporary file to original file
-			if err := os.Rename(tmpFilename, conf.Filename); err != nil {
-				restoreBackup(conf.Filename, backupFilename)
-				return err
-			}
-
-			// Remove backup file after successful processing
-			os.Remove(backupFilename)
+	}
+	if kind != "" {
+		lines, err = findSymbol(src, lang, char, kind, name)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
-	return nil
-}
 
-func shouldProcessLine(currentLine int, lineNum [2]int, startLabel, endLabel string, inSection bool) bool {
-	if startLabel != "" && endLabel != "" {
-		return inSection
+	var changed [][2]int
+	if conf.GitDiff != "" || conf.Staged || conf.Unstaged {
+		if conf.Filename == "" || isStdin {
+			return nil, nil, errors.New("changed lines can only be selected in a file")
+		}
+		changed, err = git.ChangedLines(conf.Filename, conf.GitDiff, conf.Staged)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if conf.Ranges != nil {
+		if changed == nil {
+			changed = conf.Ranges
+		} else {
+			changed = intersectRanges(changed, conf.Ranges)
+		}
 	}
-	return lineNum[0] <= currentLine && currentLine <= lineNum[1]
-}
 
-func writeChanges(inputFile *os.File, outputFile *os.File, lineNum [2]int, startLabel, endLabel string, commentChars string, modFunc func(string, string) string) error {
-	scanner := bufio.NewScanner(inputFile)
-	writer := bufio.NewWriter(outputFile)
-	currentLine := 1
-	inSection := false
-	var err error
+	match, err := compilePatterns(conf.Match)
+	if err != nil {
+		return nil, nil, err
+	}
+	notMatch, err := compilePatterns(conf.NotMatch)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep, err := newReport(conf.Filename, conf.Format)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for scanner.Scan() {
-		lineContent := scanner.Text()
-		if strings.Contains(lineContent, endLabel) {
-			inSection = false
+	sel := selection{
+		lines:      lines,
+		startLabel: conf.StartLabel,
+		endLabel:   conf.EndLabel,
+		grammar:    syntax.Lookup(lang),
+		match:      match,
+		notMatch:   notMatch,
+		changed:    changed,
+	}
+	if expand {
+		sel.expanded, err = expandSelection(src, sel, char, conf.Before, conf.After, conf.Statement)
+		if err != nil {
+			return nil, nil, err
 		}
+	}
+	return &editor{char: char, modFunc: modFunc, sel: sel, rep: rep, isStdin: isStdin}, input, nil
+}
 
-		if shouldProcessLine(currentLine, lineNum, startLabel, endLabel, inSection) {
-			lineContent = modFunc(lineContent, commentChars)
+// symbolQuery returns the kind and name of the symbol selected by conf, if
+// any. A symbol replaces line numbers and labels, so they cannot be combined.
+func symbolQuery(conf Config) (string, string, error) {
+	var kind, name string
+	for _, query := range [][2]string{{SymbolFunc, conf.Func}, {SymbolType, conf.Type}, {SymbolBlock, conf.Block}} {
+		if query[1] == "" {
+			continue
 		}
-
-		if strings.Contains(lineContent, startLabel) {
-			inSection = true
+		if kind != "" {
+			return "", "", fmt.Errorf("only one of func, type and block can be selected")
 		}
+		kind, name = query[0], query[1]
+	}
+	if kind != "" && (conf.LineNum != "" || conf.StartLabel != "" || conf.EndLabel != "") {
+		return "", "", fmt.Errorf("cannot select a %s together with lines or labels", kind)
+	}
+	return kind, name, nil
+}
+
+// inputError names the offending input in errors from decodeInput.
+func inputError(filename string, err error) error {
+	if filename == "" {
+		filename = "stdin"
+	}
+	return fmt.Errorf("%w: %s", err, filename)
+}
 
-		if _, err = writer.WriteString(lineContent + "\n"); err != nil {
+// readSource reads the whole decoded content of input, for selections that
+// must look at it before it is modified. It returns a reader with the
+// content that was consumed, to be modified.
+func readSource(input io.Reader, conf Config) ([]byte, io.Reader, error) {
+	raw, err := io.ReadAll(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoded, _, err := decodeInput(bytes.NewReader(raw), conf.Force)
+	if err != nil {
+		return nil, nil, inputError(conf.Filename, err)
+	}
+	src, err := io.ReadAll(decoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, bytes.NewReader(raw), nil
+}
+
+// rewriteFile writes the modified content of file to a temporary file in the
+// same directory, syncs it and renames it over the original once it is
+// complete, so a crash leaves either the old or the new content. The
+// temporary file gets the mode, owner and extended attributes of the
+// original, and symlinks are followed unless conf.NoFollow is set. If the
+// file no longer matches what was read, ErrFileChanged is returned and the
+// file is left alone. The backup requested by conf is taken right before
+// the rename.
+func rewriteFile(file *os.File, conf Config, sel selection, char string, modFunc func(string, string) string) error {
+	backupFilename, err := backupName(conf.Filename, conf.Backup, conf.BackupDir, conf.Suffix)
+	if err != nil {
+		return err
+	}
+
+	target := conf.Filename
+	if !conf.NoFollow {
+		target, err = filepath.EvalSymlinks(conf.Filename)
+		if err != nil {
 			return err
 		}
+	}
 
-		currentLine++
+	info, err := file.Stat()
+	if err != nil {
+		return err
 	}
 
-	if lineNum[1] > currentLine && startLabel == "" && endLabel == "" {
-		return errors.New("line number is out of range")
+	tmpFile, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
 	}
+	tmpFilename := tmpFile.Name()
+	defer os.Remove(tmpFilename)
+	defer tmpFile.Close()
 
-	if err = scanner.Err(); err != nil {
+	// Chown before chmod: changing the owner clears the setuid and setgid bits
+	if err := copyOwner(info, tmpFile); err != nil {
+		return err
+	}
+	if err := tmpFile.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+		return err
+	}
+	if err := copyXattrs(file, tmpFile); err != nil {
 		return err
 	}
 
-	return writer.Flush()
-}
+	before, err := snapshotOf(file)
+	if err != nil {
+		return err
+	}
+	if conf.Original != nil {
+		*conf.Original = before
+	}
+	if conf.Expect != nil && !conf.Expect.Matches(before) {
+		return fmt.Errorf("%s changed since it was selected: %w", conf.Filename, ErrFileChanged)
+	}
 
-func printChanges(inputFile *os.File, lineNum [2]int, startLabel, endLabel, commentChars string, modFunc func(string, string) string) error {
-	scanner := bufio.NewScanner(inputFile)
-	currentLine := 1
-	inSection := false
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 
-	for scanner.Scan() {
+	// Comment markers are written in the encoding of the file itself
+	input, enc, err := decodeInput(file, conf.Force)
+	if err != nil {
+		return inputError(conf.Filename, err)
+	}
+	output := encodeOutput(tmpFile, enc)
+	if err := writeChanges(input, output, sel, char, modFunc); err != nil {
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
 
-		lineContent := scanner.Text()
+	// Flush the content to disk and close the temporary file before renaming
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	written, err := snapshotOf(tmpFile)
+	if err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
 
-		if strings.Contains(lineContent, endLabel) {
-			inSection = false
-		}
+	// An editor may have saved the file while we were processing it
+	if err := verifyUnchanged(target, before); err != nil {
+		return err
+	}
 
-		if shouldProcessLine(currentLine, lineNum, startLabel, endLabel, inSection) {
-			modified := modFunc(lineContent, commentChars)
-			fmt.Printf("%d: %s -> %s\n", currentLine, lineContent, modified)
+	if backupFilename != "" {
+		if err := createBackup(conf.Filename, backupFilename); err != nil {
+			return fmt.Errorf("failed to create backup %s: %w", backupFilename, err)
 		}
+	}
 
-		if strings.Contains(lineContent, startLabel) {
-			inSection = true
-		}
+	// Rename temporary file to original file
+	if err := os.Rename(tmpFilename, target); err != nil {
+		return err
+	}
+	if conf.Written != nil {
+		*conf.Written = written
+	}
+	return syncDir(filepath.Dir(target))
+}
 
-		currentLine++
+// openLocked opens filename and takes an exclusive advisory lock on it.
+// Another process may have replaced the file while we were waiting for the
+// lock, in which case the lock is held on a stale inode and the file is
+// opened again.
+func openLocked(filename string) (*os.File, error) {
+	for {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := LockFile(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", filename, err)
+		}
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(filename)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
 	}
+}
 
-	if lineNum[1] > currentLine && startLabel == "" && endLabel == "" {
-		return errors.New("line number is out of range")
+// selection describes which lines of the input are modified.
+type selection struct {
+	lines      [2]int
+	startLabel string
+	endLabel   string
+	grammar    *syntax.Grammar // nil when the language has no grammar
+	match      []*regexp.Regexp
+	notMatch   []*regexp.Regexp
+	changed    [][2]int       // if not nil, only lines in these ranges can be selected
+	expanded   map[int]string // if set, the selected lines and their patterns after expansion
+}
+
+func shouldProcessLine(currentLine int, lineNum [2]int, startLabel, endLabel string, inSection bool) bool {
+	if startLabel != "" && endLabel != "" {
+		return inSection
 	}
+	return lineNum[0] <= currentLine && currentLine <= lineNum[1]
+}
 
-	return scanner.Err()
+// isEditable tells whether a selected line may be modified. Without a
+// grammar every line is. With one, lines inside string literals and
+// heredocs are never touched, and comment lines are only modified when they
+// start with the comment marker, so that toggling leaves the inside of
+// block comments alone. The lexer must see every line of the input.
+func isEditable(lexer *syntax.Lexer, line, commentChars string) bool {
+	if lexer == nil {
+		return true
+	}
+	switch lexer.Next(line) {
+	case syntax.String:
+		return false
+	case syntax.Comment:
+		return strings.HasPrefix(strings.TrimSpace(line), commentChars)
+	}
+	return true
 }
 
-func printOutput(input *os.File, lineNum [2]int, startLabel, endLabel, commentChars string, modFunc func(string, string) string) error {
+// scanSelection calls fn with every line of input and its line ending,
+// telling whether it is selected and which pattern selected it. Lines that
+// are not editable are never selected. A selected line can open a string,
+// block comment or heredoc that goes on over the next lines: these are
+// carried, as commenting out the selected line alone would turn them into
+// code. It returns the number of lines read.
+func scanSelection(input io.Reader, sel selection, commentChars string, fn func(n int, line, eol string, selected, carried bool, pattern string) error) (int, error) {
 	scanner := bufio.NewScanner(input)
-	currentLine := 1
+	scanner.Split(scanLines)
+	lexer := syntax.NewLexer(sel.grammar)
+	currentLine := 0
 	inSection := false
+	carry := false
 
 	for scanner.Scan() {
-
-		lineContent := scanner.Text()
-
-		if strings.Contains(lineContent, endLabel) {
+		currentLine++
+		lineContent, eol := splitEOL(scanner.Text())
+		editable := isEditable(lexer, lineContent, commentChars)
+		if strings.Contains(lineContent, sel.endLabel) {
 			inSection = false
 		}
 
-		if shouldProcessLine(currentLine, lineNum, startLabel, endLabel, inSection) {
-			lineContent = modFunc(lineContent, commentChars)
-
+		selected, pattern := sel.selects(currentLine, lineContent, inSection)
+		carried := carry && !(editable && selected)
+		if err := fn(currentLine, lineContent, eol, editable && selected, carried, pattern); err != nil {
+			return currentLine, err
 		}
+		carry = (carried || editable && selected) && lexer != nil && lexer.Open()
 
-		if strings.Contains(lineContent, startLabel) {
+		if strings.Contains(lineContent, sel.startLabel) {
 			inSection = true
 		}
-		fmt.Println(lineContent)
-		currentLine++
 	}
+	return currentLine, scanner.Err()
+}
 
-	if lineNum[1] > currentLine && startLabel == "" && endLabel == "" {
-		return errors.New("line number is out of range")
+// scanLines is bufio.ScanLines keeping the line endings, so that files
+// with CRLF line endings are written back with them.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF {
+		return len(data), data, nil
 	}
+	return 0, nil, nil
+}
 
-	return scanner.Err()
+// splitEOL splits a line read by scanLines from its line ending, which is
+// empty for a last line without one.
+func splitEOL(line string) (string, string) {
+	for _, eol := range []string{"\r\n", "\n"} {
+		if strings.HasSuffix(line, eol) {
+			return strings.TrimSuffix(line, eol), eol
+		}
+	}
+	return line, ""
 }
 
-func createBackup(filename, backupFilename string) error {
-	inputFile, err := os.Open(filename)
-	if err != nil {
-		return err
+// checkRange fails when the selected line range goes past the last line.
+func checkRange(sel selection, lineCount int) error {
+	if sel.lines[1] > lineCount+1 && sel.startLabel == "" && sel.endLabel == "" {
+		return errors.New("line number is out of range")
 	}
-	defer inputFile.Close()
+	return nil
+}
 
-	backupFile, err := os.Create(backupFilename)
+func writeChanges(inputFile io.Reader, outputFile io.Writer, sel selection, commentChars string, modFunc func(string, string) string) error {
+	writer := bufio.NewWriter(outputFile)
+	mod := carryComments(modFunc, sel.grammar)
+	lineCount, err := scanSelection(inputFile, sel, commentChars, func(_ int, line, eol string, selected, carried bool, _ string) error {
+		line, _ = mod(line, commentChars, selected, carried)
+		if eol == "" {
+			eol = "\n"
+		}
+		_, err := writer.WriteString(line + eol)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	defer backupFile.Close()
+	if err := checkRange(sel, lineCount); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
 
-	_, err = io.Copy(backupFile, inputFile)
+func printChanges(inputFile io.Reader, output io.Writer, sel selection, rep report, commentChars string, modFunc func(string, string) string) error {
+	mod := carryComments(modFunc, sel.grammar)
+	lineCount, err := scanSelection(inputFile, sel, commentChars, func(n int, line, _ string, selected, carried bool, pattern string) error {
+		modified, ok := mod(line, commentChars, selected, carried)
+		if !ok {
+			return nil
+		}
+		return rep.print(output, n, line, modified, pattern)
+	})
 	if err != nil {
 		return err
 	}
+	return checkRange(sel, lineCount)
+}
 
-	return nil
+// carryComments returns modFunc applied to selected lines. Carried lines
+// are commented out when the selected line before them was commented out,
+// and left alone otherwise. The other way round, uncommenting a line that
+// opens a string or block comment also uncomments the lines up to its end,
+// which grammar tells from the result. ok tells whether the line was
+// selected or carried.
+func carryComments(modFunc func(string, string) string, grammar *syntax.Grammar) func(line, commentChars string, selected, carried bool) (string, bool) {
+	lexer := syntax.NewLexer(grammar)
+	commented, uncommented := false, false
+	return func(line, commentChars string, selected, carried bool) (string, bool) {
+		modified, ok := line, true
+		switch {
+		case selected:
+			modified = modFunc(line, commentChars)
+			commented = modified != line && isCommented(modified, commentChars)
+			uncommented = modified != line && !commented
+		case carried && commented:
+			modified = commenter.Comment(line, commentChars)
+		case uncommented:
+			modified = commenter.Uncomment(line, commentChars)
+		default:
+			ok = false
+		}
+		if lexer != nil {
+			lexer.Next(modified)
+		}
+		uncommented = uncommented && lexer != nil && lexer.Open()
+		return modified, ok
+	}
 }
 
-func restoreBackup(filename, backupFilename string) {
-	// Remove the potentially corrupted file
-	os.Remove(filename)
-	// Restore the backup file
-	os.Rename(backupFilename, filename)
+// isCommented tells whether line starts with the comment marker.
+func isCommented(line, commentChars string) bool {
+	trimmed := strings.TrimSpace(line)
+	if commentChars == "<!-- -->" {
+		return strings.HasPrefix(trimmed, "<!--")
+	}
+	return commentChars != "" && strings.HasPrefix(trimmed, commentChars)
 }
 
 func findLines(lineStr string) ([2]int, error) {
@@ -307,83 +665,95 @@ func findLines(lineStr string) ([2]int, error) {
 	}
 }
 
-func selectCommentChars(filename, lang string) (string, error) {
+// selectLanguage returns the CommentChars key of the language given by lang
+// or, when lang is empty, guessed from the extension of filename.
+func selectLanguage(filename, lang string) (string, error) {
 	if lang != "" {
 		lang = strings.ToLower(lang)
-		commentChars, ok := CommentChars[lang]
-		if !ok {
+		if _, ok := CommentChars[lang]; !ok {
 			return "", fmt.Errorf("unsupported language: %s", lang)
 		}
-		return commentChars, nil
+		return lang, nil
 	}
 
 	if filename != "" {
 		extension := filepath.Ext(filename)
 		switch extension {
 		case ".go":
-			return CommentChars["golang"], nil
+			return "golang", nil
 		case ".js":
-			return CommentChars["js"], nil
+			return "js", nil
 		case ".sh", ".bash":
-			return CommentChars["bash"], nil
+			return "bash", nil
 		case ".cpp", ".cc", ".h", ".c", ".cs":
-			return CommentChars["c"], nil
+			return "c", nil
 		case ".java":
-			return CommentChars["java"], nil
+			return "java", nil
 		case ".py":
-			return CommentChars["python"], nil
+			return "python", nil
 		case ".rb":
-			return CommentChars["ruby"], nil
+			return "ruby", nil
 		case ".pl":
-			return CommentChars["perl"], nil
+			return "perl", nil
 		case ".php":
-			return CommentChars["php"], nil
+			return "php", nil
 		case ".swift":
-			return CommentChars["swift"], nil
+			return "swift", nil
 		case ".kt", ".kts":
-			return CommentChars["kotlin"], nil
+			return "kotlin", nil
 		case ".R":
-			return CommentChars["r"], nil
+			return "r", nil
 		case ".hs":
-			return CommentChars["haskell"], nil
+			return "haskell", nil
 		case ".sql":
-			return CommentChars["sql"], nil
+			return "sql", nil
 		case ".rs":
-			return CommentChars["rust"], nil
+			return "rust", nil
 		case ".scala":
-			return CommentChars["scala"], nil
+			return "scala", nil
 		case ".dart":
-			return CommentChars["dart"], nil
+			return "dart", nil
 		case ".mm":
-			return CommentChars["objective-c"], nil
+			return "objective-c", nil
 		case ".m":
-			return CommentChars["matlab"], nil
+			return "matlab", nil
 		case ".lua":
-			return CommentChars["lua"], nil
+			return "lua", nil
 		case ".erl":
-			return CommentChars["erlang"], nil
+			return "erlang", nil
 		case ".ex", ".exs":
-			return CommentChars["elixir"], nil
+			return "elixir", nil
 		case ".ts":
-			return CommentChars["ts"], nil
+			return "ts", nil
 		case ".vhdl", ".vhd":
-			return CommentChars["vhdl"], nil
+			return "vhdl", nil
 		case ".v", ".sv":
-			return CommentChars["verilog"], nil
+			return "verilog", nil
 		case ".slang":
-			return CommentChars["slangroom"], nil
+			return "slangroom", nil
 		case ".zen":
-			return CommentChars["zenroom"], nil
+			return "zenroom", nil
 		case ".html":
-			return CommentChars["html"], nil
+			return "html", nil
 		default:
-			return "", fmt.Errorf("unsupported file extension: %s", extension)
+			return "", fmt.Errorf("%w: %s", ErrUnsupportedExtension, extension)
 		}
 	}
 
 	return "", fmt.Errorf("language not specified and no filename provided")
 }
 
+// Supported reports whether the language of filename is known, or given by
+// lang.
+func Supported(filename, lang string) bool {
+	_, err := selectLanguage(filename, lang)
+	return err == nil
+}
+
+// ErrUnsupportedExtension is returned when the language cannot be told from
+// the extension of the file.
+var ErrUnsupportedExtension = errors.New("unsupported file extension")
+
 // CommentChars maps programming languages to their respective comment syntax.
 var CommentChars = map[string]string{
 	"golang":      "//",
@@ -2,9 +2,19 @@ package modfile
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/dyne/tgcom/utils/git"
 )
 
 func TestWriteChanges(t *testing.T) {
@@ -80,7 +90,7 @@ func TestWriteChanges(t *testing.T) {
 			}()
 
 			// Call writeChanges function
-			err = writeChanges(file, outputFile, tt.lineNum, tt.startLabel, tt.endLabel, tt.commentChars, tt.modFunc)
+			err = writeChanges(file, outputFile, selection{lines: tt.lineNum, startLabel: tt.startLabel, endLabel: tt.endLabel}, tt.commentChars, tt.modFunc)
 			if err != nil {
 				t.Fatalf("writeChanges returned an error: %v", err)
 			}
@@ -163,7 +173,7 @@ func TestPrintChanges(t *testing.T) {
 			// Redirect stdout to buffer
 
 			// Call printChanges function
-			err = printChanges(file, tt.lineNum, tt.startLabel, tt.endLabel, tt.commentChars, tt.modFunc)
+			err = printChanges(file, os.Stdout, selection{lines: tt.lineNum, startLabel: tt.startLabel, endLabel: tt.endLabel}, report{}, tt.commentChars, tt.modFunc)
 			if err != nil {
 				t.Fatalf("printChanges returned an error: %v", err)
 			}
@@ -343,6 +353,26 @@ func TestChangeFile(t *testing.T) {
 			t.Errorf("expected %q, got %q", expected, got)
 		}
 	})
+	t.Run("StdinChangedLines", func(t *testing.T) {
+		rStdin, wStdin, _ := os.Pipe()
+		wStdin.Close()
+		defer rStdin.Close()
+		oldStdin := os.Stdin
+		defer func() { os.Stdin = oldStdin }()
+		os.Stdin = rStdin
+
+		// Naming stdin after a file does not make it that file
+		for _, conf := range []Config{
+			{GitDiff: "HEAD"},
+			{Staged: true, StdinFilename: "main.go"},
+			{Unstaged: true, Filename: StdinName, StdinFilename: "main.go"},
+		} {
+			conf.Lang = "go"
+			if err := ChangeFile(conf); err == nil || !strings.Contains(err.Error(), "only be selected in a file") {
+				t.Errorf("expected an error selecting changed lines of stdin with %+v, got %v", conf, err)
+			}
+		}
+	})
 
 }
 
@@ -361,43 +391,686 @@ func TestCreateBackup(t *testing.T) {
 	assertFileContent(t, backupFile.Name(), content)
 }
 
-func TestRestoreBackup(t *testing.T) {
+func TestBackupName(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "main.go")
+	backupDir := filepath.Join(dir, "backups")
+	// Files outside of the working directory keep their absolute path
+	volume := filepath.VolumeName(filename)
+	outside := filepath.Join(backupDir, strings.TrimSuffix(volume, ":"), filename[len(volume):])
+
+	tests := []struct {
+		name      string
+		policy    string
+		backupDir string
+		suffix    string
+		existing  []string
+		expected  string
+		shouldErr bool
+	}{
+		{"None", "none", "", "", nil, "", false},
+		{"Empty", "", "", "", nil, "", false},
+		{"Simple", "simple", "", "", nil, filename + "~", false},
+		{"SimpleSuffix", "simple", "", ".orig", nil, filename + ".orig", false},
+		{"SimpleBackupDir", "simple", backupDir, "", nil, outside + "~", false},
+		{"Numbered", "numbered", "", "", nil, filename + ".~1~", false},
+		{"NumberedNext", "numbered", "", "", []string{".~1~", ".~7~"}, filename + ".~8~", false},
+		{"ExistingWithoutNumbered", "existing", "", "", nil, filename + "~", false},
+		{"ExistingWithNumbered", "existing", "", "", []string{".~2~"}, filename + ".~3~", false},
+		{"Alias", "t", "", "", nil, filename + ".~1~", false},
+		{"Invalid", "sometimes", "", "", nil, "", true},
+		{"InvalidSuffix", "simple", "", "/x", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, suffix := range tt.existing {
+				if err := os.WriteFile(filename+suffix, nil, 0644); err != nil {
+					t.Fatalf("failed to create existing backup: %v", err)
+				}
+				defer os.Remove(filename + suffix)
+			}
+			got, err := backupName(filename, tt.policy, tt.backupDir, tt.suffix)
+			if (err != nil) != tt.shouldErr {
+				t.Fatalf("backupName() error = %v, wantErr %v", err, tt.shouldErr)
+			}
+			if got != tt.expected {
+				t.Errorf("backupName() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestChangeFileBackup(t *testing.T) {
 	content := "Line 1\nLine 2\n"
+
+	t.Run("NoBackupByDefault", func(t *testing.T) {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "main.go")
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		// A pre-existing .bak belongs to the user and must survive
+		if err := os.WriteFile(filename+".bak", []byte("mine"), 0644); err != nil {
+			t.Fatalf("failed to write .bak file: %v", err)
+		}
+
+		if err := ChangeFile(Config{Filename: filename, LineNum: "1", Action: "comment"}); err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+
+		assertFileContent(t, filename, "// Line 1\nLine 2\n")
+		assertFileContent(t, filename+".bak", "mine")
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 2 {
+			t.Errorf("expected only the file and its .bak in %s, got %d entries", dir, len(entries))
+		}
+	})
+
+	t.Run("SimpleKeepsBackup", func(t *testing.T) {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "main.go")
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+
+		conf := Config{Filename: filename, LineNum: "1", Action: "comment", Backup: BackupSimple}
+		if err := ChangeFile(conf); err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+
+		assertFileContent(t, filename, "// Line 1\nLine 2\n")
+		assertFileContent(t, filename+"~", content)
+	})
+
+	t.Run("NumberedInBackupDir", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		if err := os.WriteFile("main.go", []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+
+		conf := Config{Filename: "main.go", LineNum: "1", Action: "toggle", Backup: BackupNumbered, BackupDir: "backups"}
+		for i := 0; i < 2; i++ {
+			if err := ChangeFile(conf); err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+		}
+
+		assertFileContent(t, "main.go", content)
+		assertFileContent(t, filepath.Join("backups", "main.go.~1~"), content)
+		assertFileContent(t, filepath.Join("backups", "main.go.~2~"), "// Line 1\nLine 2\n")
+	})
+
+	t.Run("SameNameInBackupDir", func(t *testing.T) {
+		chdir(t, t.TempDir())
+		files := []string{filepath.Join("a", "main.go"), filepath.Join("b", "main.go")}
+		for _, filename := range files {
+			if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filename, []byte(filename+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write test file: %v", err)
+			}
+		}
+
+		for _, filename := range files {
+			conf := Config{Filename: filename, LineNum: "1", Action: "comment", Backup: BackupSimple, BackupDir: "backups"}
+			if err := ChangeFile(conf); err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+		}
+
+		// Each file keeps its own backup
+		for _, filename := range files {
+			assertFileContent(t, filepath.Join("backups", filename+"~"), filename+"\n")
+		}
+	})
+}
+
+// chdir changes the working directory to dir until the end of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestChangeFilePreservesAttributes(t *testing.T) {
+	content := "echo one\necho two\n"
+	expected := "# echo one\necho two\n"
+
+	t.Run("Mode", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "run.sh")
+		if err := os.WriteFile(filename, []byte(content), 0750); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+
+		if err := ChangeFile(Config{Filename: filename, LineNum: "1", Action: "comment"}); err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+
+		assertFileContent(t, filename, expected)
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatalf("failed to stat file: %v", err)
+		}
+		if info.Mode().Perm() != 0750 {
+			t.Errorf("expected mode 0750, got %o", info.Mode().Perm())
+		}
+	})
+
+	t.Run("FollowSymlink", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "real.sh")
+		link := filepath.Join(dir, "link.sh")
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		if err := os.Symlink("real.sh", link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+
+		if err := ChangeFile(Config{Filename: link, LineNum: "1", Action: "comment"}); err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+
+		info, err := os.Lstat(link)
+		if err != nil {
+			t.Fatalf("failed to lstat link: %v", err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected %s to still be a symlink", link)
+		}
+		assertFileContent(t, target, expected)
+	})
+
+	t.Run("NoFollow", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "real.sh")
+		link := filepath.Join(dir, "link.sh")
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		if err := os.Symlink("real.sh", link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+
+		if err := ChangeFile(Config{Filename: link, LineNum: "1", Action: "comment", NoFollow: true}); err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+
+		info, err := os.Lstat(link)
+		if err != nil {
+			t.Fatalf("failed to lstat link: %v", err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("expected %s to be replaced by a regular file", link)
+		}
+		assertFileContent(t, link, expected)
+		assertFileContent(t, target, content)
+	})
+}
+
+func TestChangeFileConcurrent(t *testing.T) {
+	const numLines = 32
+	var content, expected strings.Builder
+	for i := 1; i <= numLines; i++ {
+		fmt.Fprintf(&content, "Line %d\n", i)
+		fmt.Fprintf(&expected, "// Line %d\n", i)
+	}
+	filename := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(filename, []byte(content.String()), 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	// Every goroutine comments a different line: without locking, a rewrite
+	// based on a stale read would drop the comments added by the others.
+	var wg sync.WaitGroup
+	errs := make(chan error, numLines)
+	for i := 1; i <= numLines; i++ {
+		wg.Add(1)
+		go func(line int) {
+			defer wg.Done()
+			errs <- ChangeFile(Config{Filename: filename, LineNum: strconv.Itoa(line), Action: "comment"})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("No error expected got: %s", err)
+		}
+	}
+	assertFileContent(t, filename, expected.String())
+
+	entries, _ := os.ReadDir(filepath.Dir(filename))
+	if len(entries) != 1 {
+		t.Errorf("expected temporary files to be removed, got %d entries", len(entries))
+	}
+}
+
+func TestChangeFileDetectsChanges(t *testing.T) {
+	content := "Line 1\nLine 2\n"
+
+	t.Run("ChangedWhileProcessing", func(t *testing.T) {
+		tmpFile, cleanup := createTempFile(t, content)
+		defer cleanup()
+
+		file, err := os.Open(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("failed to open test file: %v", err)
+		}
+		defer file.Close()
+
+		// Simulate an editor saving the file while tgcom is processing it
+		modFunc := func(line, commentChars string) string {
+			if err := os.WriteFile(tmpFile.Name(), []byte("edited\n"), 0644); err != nil {
+				t.Fatalf("failed to modify test file: %v", err)
+			}
+			return "// " + line
+		}
+
+		conf := Config{Filename: tmpFile.Name()}
+		err = rewriteFile(file, conf, selection{lines: [2]int{1, 1}}, "//", modFunc)
+		if !errors.Is(err, ErrFileChanged) {
+			t.Fatalf("expected ErrFileChanged, got %v", err)
+		}
+		assertFileContent(t, tmpFile.Name(), "edited\n")
+	})
+
+	t.Run("ChangedSinceSnapshot", func(t *testing.T) {
+		tmpFile, cleanup := createTempFile(t, content)
+		defer cleanup()
+
+		snapshot, err := TakeSnapshot(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("TakeSnapshot() error = %v", err)
+		}
+		if err := os.WriteFile(tmpFile.Name(), []byte("edited\n"), 0644); err != nil {
+			t.Fatalf("failed to modify test file: %v", err)
+		}
+
+		conf := Config{Filename: tmpFile.Name(), LineNum: "1", Lang: "go", Action: "comment", Expect: &snapshot}
+		if err := ChangeFile(conf); !errors.Is(err, ErrFileChanged) {
+			t.Fatalf("expected ErrFileChanged, got %v", err)
+		}
+		assertFileContent(t, tmpFile.Name(), "edited\n")
+	})
+
+	t.Run("UnchangedSinceSnapshot", func(t *testing.T) {
+		tmpFile, cleanup := createTempFile(t, content)
+		defer cleanup()
+
+		snapshot, err := TakeSnapshot(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("TakeSnapshot() error = %v", err)
+		}
+
+		conf := Config{Filename: tmpFile.Name(), LineNum: "1", Lang: "go", Action: "comment", Expect: &snapshot}
+		if err := ChangeFile(conf); err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+		assertFileContent(t, tmpFile.Name(), "// Line 1\nLine 2\n")
+	})
+}
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		sample   []byte
+		expected string
+	}{
+		{"Empty", []byte{}, EncodingUTF8},
+		{"ASCII", []byte("package main\n"), EncodingUTF8},
+		{"UTF8", []byte("// caffè\n"), EncodingUTF8},
+		{"UTF8Truncated", []byte("caff\xc3"), EncodingUTF8},
+		{"UTF8BOM", []byte("\xef\xbb\xbfline\n"), EncodingUTF8BOM},
+		{"UTF16LE", []byte("\xff\xfel\x00i\x00"), EncodingUTF16LE},
+		{"UTF16BE", []byte("\xfe\xff\x00l\x00i"), EncodingUTF16BE},
+		{"Latin1", []byte("caff\xe8\n"), EncodingLatin1},
+		{"Binary", []byte("\x89PNG\r\n\x1a\n\x00\x00"), EncodingBinary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectEncoding(tt.sample); got != tt.expected {
+				t.Errorf("DetectEncoding(%q) = %s, want %s", tt.sample, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestChangeFileEncodings(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		force     bool
+		expected  string
+		shouldErr error
+	}{
+		{
+			name:      "BinaryRefused",
+			content:   "\x00\x01\x02\nLine 2\n",
+			shouldErr: ErrBinaryFile,
+		},
+		{
+			name:     "BinaryForced",
+			content:  "\x00\x01\x02\nLine 2\n",
+			force:    true,
+			expected: "// \x00\x01\x02\nLine 2\n",
+		},
+		{
+			name:     "Latin1",
+			content:  "caff\xe8\nLine 2\n",
+			expected: "// caff\xe8\nLine 2\n",
+		},
+		{
+			name:     "UTF8BOM",
+			content:  "\xef\xbb\xbfLine 1\nLine 2\n",
+			expected: "\xef\xbb\xbf// Line 1\nLine 2\n",
+		},
+		{
+			name:     "UTF16LE",
+			content:  "\xff\xfeL\x001\x00\n\x00L\x002\x00\n\x00",
+			expected: "\xff\xfe/\x00/\x00 \x00L\x001\x00\n\x00L\x002\x00\n\x00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile, cleanup := createTempFile(t, tt.content)
+			defer cleanup()
+
+			conf := Config{Filename: tmpFile.Name(), LineNum: "1", Lang: "go", Action: "comment", Force: tt.force}
+			err := ChangeFile(conf)
+			if tt.shouldErr != nil {
+				if !errors.Is(err, tt.shouldErr) {
+					t.Fatalf("expected %v, got %v", tt.shouldErr, err)
+				}
+				assertFileContent(t, tmpFile.Name(), tt.content)
+				return
+			}
+			if err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+			assertFileContent(t, tmpFile.Name(), tt.expected)
+		})
+	}
+}
+
+func TestFindSymbol(t *testing.T) {
+	goSrc := `package main
+
+// handleLogin logs a user in
+func handleLogin() {
+	if debug {
+		log.Println("login")
+	}
+}
+
+type Server struct {
+	addr string
+}
+
+func (s *Server) Start() error {
+	return nil
+}
+
+// func oldHandler() {
+// 	return
+// }
+`
+	pySrc := `import os
+
+def main():
+    x = {"a": 1}
+
+    print(x)
+
+class Config:
+    def load(self):
+        pass
+
+main()
+`
+	cSrc := `#include <stdio.h>
+
+static int add(int a, int b);
+
+static int add(int a, int b)
+{
+	return a + b;
+}
+
+int main(void) {
+	return add(1, 2);
+}
+`
+	jsSrc := `const handler = async (req) => {
+	return req;
+};
+
+class Api {
+	fetch(url) {
+		return url;
+	}
+}
+`
+
+	tests := []struct {
+		name      string
+		src       string
+		lang      string
+		kind      string
+		symbol    string
+		expected  [2]int
+		shouldErr bool
+	}{
+		{"GoFunc", goSrc, "go", SymbolFunc, "handleLogin", [2]int{4, 8}, false},
+		{"GoMethod", goSrc, "go", SymbolFunc, "Server.Start", [2]int{14, 16}, false},
+		{"GoMethodByName", goSrc, "go", SymbolFunc, "Start", [2]int{14, 16}, false},
+		{"GoType", goSrc, "go", SymbolType, "Server", [2]int{10, 12}, false},
+		{"GoCommentedFunc", goSrc, "go", SymbolFunc, "oldHandler", [2]int{18, 20}, false},
+		{"GoBlock", goSrc, "go", SymbolBlock, "if debug", [2]int{5, 7}, false},
+		{"GoMissing", goSrc, "go", SymbolFunc, "missing", [2]int{0, 0}, true},
+		{"GoWrongReceiver", goSrc, "go", SymbolFunc, "Client.Start", [2]int{0, 0}, true},
+		{"PythonFunc", pySrc, "python", SymbolFunc, "main", [2]int{3, 6}, false},
+		{"PythonClass", pySrc, "python", SymbolType, "Config", [2]int{8, 10}, false},
+		{"PythonMethod", pySrc, "python", SymbolFunc, "Config.load", [2]int{9, 10}, false},
+		{"CFunc", cSrc, "c", SymbolFunc, "add", [2]int{5, 8}, false},
+		{"CMain", cSrc, "c", SymbolFunc, "main", [2]int{10, 12}, false},
+		{"JSArrow", jsSrc, "js", SymbolFunc, "handler", [2]int{1, 3}, false},
+		{"JSMethod", jsSrc, "js", SymbolFunc, "Api.fetch", [2]int{6, 8}, false},
+		{"Ambiguous", "return\nreturn\n", "go", SymbolBlock, "return", [2]int{0, 0}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := findSymbol([]byte(tt.src), tt.lang, CommentChars[tt.lang], tt.kind, tt.symbol)
+			if (err != nil) != tt.shouldErr {
+				t.Fatalf("findSymbol() error = %v, wantErr %v", err, tt.shouldErr)
+			}
+			if !tt.shouldErr && lines != tt.expected {
+				t.Errorf("findSymbol(%s %s) = %v, want %v", tt.kind, tt.symbol, lines, tt.expected)
+			}
+		})
+	}
+}
+
+func TestChangeFileSymbol(t *testing.T) {
+	content := "package main\n\nfunc debug() {\n\tprintln()\n}\n"
+	commented := "package main\n\n// func debug() {\n// \tprintln()\n// }\n"
+
 	tmpFile, cleanup := createTempFile(t, content)
 	defer cleanup()
 
-	backupFile, cleanupBackup := createTempFile(t, content)
-	defer cleanupBackup()
+	conf := Config{Filename: tmpFile.Name(), Lang: "go", Action: "comment", Func: "debug"}
+	if err := ChangeFile(conf); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	assertFileContent(t, tmpFile.Name(), commented)
 
-	// Corrupt the original file
-	if err := os.WriteFile(tmpFile.Name(), []byte("corrupted content"), 0644); err != nil {
-		t.Fatalf("Failed to corrupt file: %v", err)
+	// The commented-out function can still be found to uncomment it
+	conf.Action = "uncomment"
+	if err := ChangeFile(conf); err != nil {
+		t.Fatalf("No error expected got: %s", err)
 	}
+	assertFileContent(t, tmpFile.Name(), content)
 
-	restoreBackup(tmpFile.Name(), backupFile.Name())
+	conf.LineNum = "1"
+	if err := ChangeFile(conf); err == nil {
+		t.Errorf("expected an error when combining a function with lines")
+	}
+}
 
-	assertFileContent(t, tmpFile.Name(), content)
+func TestChangeFileSyntax(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		lang     string
+		lines    string
+		action   string // Defaults to toggle
+		expected string
+	}{
+		{
+			name:     "GoRawString",
+			content:  "q := `\n// keep\n`\nx := 1\n",
+			lang:     "go",
+			lines:    "1-4",
+			expected: "// q := `\n// // keep\n// `\n// x := 1\n",
+		},
+		{
+			name:     "GoRawStringOpeningLine",
+			content:  "q := `\nline\n`\nx := 1\n",
+			lang:     "go",
+			lines:    "1",
+			expected: "// q := `\n// line\n// `\nx := 1\n",
+		},
+		{
+			name:     "GoStringsOnClosingLine",
+			content:  "q := `a\n` + `b\nc`\nx := 1\n",
+			lang:     "go",
+			lines:    "1",
+			action:   "comment",
+			expected: "// q := `a\n// ` + `b\n// c`\nx := 1\n",
+		},
+		{
+			name:     "GoRawStringUncomment",
+			content:  "q := `\n// keep\n`\n",
+			lang:     "go",
+			lines:    "1",
+			action:   "uncomment",
+			expected: "q := `\n// keep\n`\n",
+		},
+		{
+			name:     "GoRawStringUncommentOpeningLine",
+			content:  "// q := `\n// // keep\n// `\n// x := 1\n",
+			lang:     "go",
+			lines:    "1",
+			action:   "uncomment",
+			expected: "q := `\n// keep\n`\n// x := 1\n",
+		},
+		{
+			name:     "GoBlockCommentUncommentOpeningLine",
+			content:  "// x := 1 /* a\n// b */\n// y := 2\n",
+			lang:     "go",
+			lines:    "1",
+			action:   "toggle",
+			expected: "x := 1 /* a\nb */\n// y := 2\n",
+		},
+		{
+			name:     "GoBlockComment",
+			content:  "/*\n doc\n*/\n// x := 1\n",
+			lang:     "go",
+			lines:    "1-4",
+			expected: "/*\n doc\n*/\nx := 1\n",
+		},
+		{
+			name:     "GoBlockCommentAfterCode",
+			content:  "x := 1 /* a\nb */\ny := 2\n",
+			lang:     "go",
+			lines:    "1",
+			action:   "comment",
+			expected: "// x := 1 /* a\n// b */\ny := 2\n",
+		},
+		{
+			name:     "JSTemplateLiteral",
+			content:  "const s = `a\n${b}\n`;\nf();\n",
+			lang:     "js",
+			lines:    "1",
+			action:   "comment",
+			expected: "// const s = `a\n// ${b}\n// `;\nf();\n",
+		},
+		{
+			name:     "PythonTripleQuotes",
+			content:  "s = \"\"\"\n# keep\n\"\"\"\n",
+			lang:     "python",
+			lines:    "1",
+			expected: "# s = \"\"\"\n# # keep\n# \"\"\"\n",
+		},
+		{
+			name:     "BashHeredoc",
+			content:  "cat <<EOF\n# keep\nEOF\n# echo hi\n",
+			lang:     "bash",
+			lines:    "1-4",
+			expected: "# cat <<EOF\n# # keep\n# EOF\necho hi\n",
+		},
+		{
+			name:     "NoGrammar",
+			content:  "<p>\n",
+			lang:     "html",
+			lines:    "1",
+			expected: "<!-- <p> -->\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile, cleanup := createTempFile(t, tt.content)
+			defer cleanup()
+
+			action := tt.action
+			if action == "" {
+				action = "toggle"
+			}
+			conf := Config{Filename: tmpFile.Name(), LineNum: tt.lines, Lang: tt.lang, Action: action}
+			if err := ChangeFile(conf); err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+			assertFileContent(t, tmpFile.Name(), tt.expected)
+		})
+	}
 }
 
-func TestSelectCommentChars(t *testing.T) {
+func TestSelectLanguage(t *testing.T) {
 	tests := []struct {
 		filename      string
+		lang          string
+		expectedLang  string
 		expectedChars string
 		shouldErr     bool
 	}{
-		{"testfile.go", "//", false},
-		{"testfile.false", "", true},
-		{"testfile.zen", "#", false},
-		{"testfile.slang", "#", false},
+		{"testfile.go", "", "golang", "//", false},
+		{"testfile.false", "", "", "", true},
+		{"testfile.zen", "", "zenroom", "#", false},
+		{"testfile.slang", "", "slangroom", "#", false},
+		{"testfile.go", "Python", "python", "#", false},
+		{"testfile.go", "cobol", "", "", true},
 	}
 
 	for _, tt := range tests {
-		commentChars, err := selectCommentChars(tt.filename, "")
+		lang, err := selectLanguage(tt.filename, tt.lang)
 		if (err != nil) != tt.shouldErr {
-			t.Errorf("selectCommentChars(%s) error = %v", tt.filename, err)
+			t.Errorf("selectLanguage(%s, %s) error = %v", tt.filename, tt.lang, err)
 		}
-		if !tt.shouldErr && commentChars != tt.expectedChars {
-			t.Errorf("selectCommentChars(%s) = %v, want %v", tt.filename, commentChars, tt.expectedChars)
+		if !tt.shouldErr && (lang != tt.expectedLang || CommentChars[lang] != tt.expectedChars) {
+			t.Errorf("selectLanguage(%s, %s) = %v with %q, want %v with %q", tt.filename, tt.lang, lang, CommentChars[lang], tt.expectedLang, tt.expectedChars)
 		}
 	}
 }
@@ -452,3 +1125,375 @@ func assertFileContent(t testing.TB, filename string, expected string) {
 		t.Errorf("Unexpected file content:\nGot:\n%s\nExpected:\n%s", string(modified), expected)
 	}
 }
+
+func TestChangeFileMatch(t *testing.T) {
+	content := "start\nlog.Debug(a)\nfmt.Println(a)\nend\nlog.Debug(b)\n"
+	tests := []struct {
+		name       string
+		lines      string
+		startLabel string
+		endLabel   string
+		match      []string
+		notMatch   []string
+		expected   string
+	}{
+		{
+			name:     "Match",
+			match:    []string{`log\.Debug\(`},
+			expected: "start\n// log.Debug(a)\nfmt.Println(a)\nend\n// log.Debug(b)\n",
+		},
+		{
+			name:     "MatchAny",
+			match:    []string{`log\.Debug\(`, `fmt\.Println`},
+			expected: "start\n// log.Debug(a)\n// fmt.Println(a)\nend\n// log.Debug(b)\n",
+		},
+		{
+			name:     "MatchInLines",
+			lines:    "3-5",
+			match:    []string{`log\.Debug\(`},
+			expected: "start\nlog.Debug(a)\nfmt.Println(a)\nend\n// log.Debug(b)\n",
+		},
+		{
+			name:       "MatchInLabels",
+			startLabel: "start",
+			endLabel:   "end",
+			match:      []string{`log\.Debug\(`},
+			expected:   "start\n// log.Debug(a)\nfmt.Println(a)\nend\nlog.Debug(b)\n",
+		},
+		{
+			name:     "NotMatch",
+			lines:    "2-3",
+			notMatch: []string{`fmt`},
+			expected: "start\n// log.Debug(a)\nfmt.Println(a)\nend\nlog.Debug(b)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile, cleanup := createTempFile(t, content)
+			defer cleanup()
+
+			conf := Config{
+				Filename:   tmpFile.Name(),
+				LineNum:    tt.lines,
+				StartLabel: tt.startLabel,
+				EndLabel:   tt.endLabel,
+				Lang:       "go",
+				Action:     "comment",
+				Match:      tt.match,
+				NotMatch:   tt.notMatch,
+			}
+			if err := ChangeFile(conf); err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+			assertFileContent(t, tmpFile.Name(), tt.expected)
+		})
+	}
+
+	tmpFile, cleanup := createTempFile(t, content)
+	defer cleanup()
+	conf := Config{Filename: tmpFile.Name(), Lang: "go", Match: []string{"("}}
+	if err := ChangeFile(conf); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("expected an invalid pattern error, got: %v", err)
+	}
+}
+
+func TestReportPrint(t *testing.T) {
+	var buf bytes.Buffer
+	text := report{}
+	if err := text.print(&buf, 2, "a", "// a", `log\.`); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	jsonReport := report{format: FormatJSON, filename: "main.go"}
+	if err := jsonReport.print(&buf, 3, "b", "// b", ""); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	expected := "2: a -> // a (match: log\\.)\n" +
+		`{"file":"main.go","line":3,"before":"b","after":"// b"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestChangeFileExpand(t *testing.T) {
+	content := "func main() {\n\tlog.Debug(\"a\",\n\t\tb)\n\tif debug {\n\t\tdump()\n\t} else {\n\t\tskip()\n\t}\n\trun()\n}\n"
+	tests := []struct {
+		name      string
+		lines     string
+		match     []string
+		before    int
+		after     int
+		statement bool
+		expected  string
+	}{
+		{
+			name:     "Context",
+			match:    []string{`dump`},
+			before:   1,
+			after:    1,
+			expected: "func main() {\n\tlog.Debug(\"a\",\n\t\tb)\n// \tif debug {\n// \t\tdump()\n// \t} else {\n\t\tskip()\n\t}\n\trun()\n}\n",
+		},
+		{
+			name:      "Call",
+			match:     []string{`\bb\)`},
+			statement: true,
+			expected:  "func main() {\n// \tlog.Debug(\"a\",\n// \t\tb)\n\tif debug {\n\t\tdump()\n\t} else {\n\t\tskip()\n\t}\n\trun()\n}\n",
+		},
+		{
+			name:      "Block",
+			match:     []string{`else`},
+			statement: true,
+			expected:  "func main() {\n\tlog.Debug(\"a\",\n\t\tb)\n// \tif debug {\n// \t\tdump()\n// \t} else {\n// \t\tskip()\n// \t}\n\trun()\n}\n",
+		},
+		{
+			name:      "StatementInBlock",
+			lines:     "7",
+			statement: true,
+			expected:  "func main() {\n\tlog.Debug(\"a\",\n\t\tb)\n\tif debug {\n\t\tdump()\n\t} else {\n// \t\tskip()\n\t}\n\trun()\n}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile, cleanup := createTempFile(t, content)
+			defer cleanup()
+
+			conf := Config{
+				Filename:  tmpFile.Name(),
+				LineNum:   tt.lines,
+				Lang:      "go",
+				Action:    "comment",
+				Match:     tt.match,
+				Before:    tt.before,
+				After:     tt.after,
+				Statement: tt.statement,
+			}
+			if err := ChangeFile(conf); err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+			assertFileContent(t, tmpFile.Name(), tt.expected)
+		})
+	}
+}
+
+func TestStatementRange(t *testing.T) {
+	lines := []string{"foo(a,", "  b)", "if x { // {", "  y()", "}"}
+	nesting := bracketNesting(lines, "//")
+	tests := []struct {
+		line     int
+		expected [2]int
+	}{
+		{0, [2]int{0, 1}},
+		{1, [2]int{0, 1}},
+		{2, [2]int{2, 4}},
+		{3, [2]int{3, 3}},
+		{4, [2]int{2, 4}},
+	}
+	for _, tt := range tests {
+		start, end := statementRange(nesting, tt.line)
+		if [2]int{start, end} != tt.expected {
+			t.Errorf("line %d: expected %v, got %v", tt.line, tt.expected, [2]int{start, end})
+		}
+	}
+}
+
+func TestChangeFileGitDiff(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(filename, []byte("a()\nb()\nc()\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "main.go"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+	if err := os.WriteFile(filename, []byte("a()\n// debug()\nb()\nc()\n// trace()\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Filename: filename, Lang: "go", Action: "uncomment", GitDiff: "HEAD"}
+	if err := ChangeFile(conf); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	assertFileContent(t, filename, "a()\ndebug()\nb()\nc()\ntrace()\n")
+
+	// Changed lines intersect with a line range
+	conf.Action = "comment"
+	conf.LineNum = "1-3"
+	if err := ChangeFile(conf); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	assertFileContent(t, filename, "a()\n// debug()\nb()\nc()\ntrace()\n")
+
+	outside, cleanup := createTempFile(t, "a()\n")
+	defer cleanup()
+	conf.Filename = outside.Name()
+	if err := ChangeFile(conf); !errors.Is(err, git.ErrNotRepository) {
+		t.Errorf("expected ErrNotRepository, got %v", err)
+	}
+}
+
+func TestUncommented(t *testing.T) {
+	content := "# START\n# a\nb\n\n  c\n# END\nd\n"
+	conf := Config{Filename: "script.py", StartLabel: "START", EndLabel: "END"}
+	lines, err := Uncommented(strings.NewReader(content), conf)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if fmt.Sprint(lines) != "[3 5]" {
+		t.Errorf("expected lines [3 5], got %v", lines)
+	}
+}
+
+// changeStdin runs ChangeFile with input on stdin and returns its output.
+func changeStdin(t *testing.T, conf Config, input string) string {
+	t.Helper()
+	rStdin, wStdin, _ := os.Pipe()
+	rStdout, wStdout, _ := os.Pipe()
+	go func() {
+		defer wStdin.Close()
+		_, _ = wStdin.Write([]byte(input))
+	}()
+
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = rStdin, wStdout
+	err := ChangeFile(conf)
+	os.Stdin, os.Stdout = oldStdin, oldStdout
+	wStdout.Close()
+	if err != nil {
+		t.Errorf("No error expected got: %s", err)
+	}
+
+	var buf bytes.Buffer
+	io.Copy(&buf, rStdout)
+	rStdout.Close()
+	return buf.String()
+}
+
+func TestChangeFileStdinFilter(t *testing.T) {
+	input := "a\n# START\nb\n# END\n"
+	tests := []struct {
+		name     string
+		conf     Config
+		expected string
+	}{
+		{
+			name:     "Labels",
+			conf:     Config{Filename: StdinName, StdinFilename: "script.py", StartLabel: "START", EndLabel: "END", Action: "comment"},
+			expected: "a\n# START\n# b\n# END\n",
+		},
+		{
+			name:     "LanguageOverridesName",
+			conf:     Config{Filename: StdinName, StdinFilename: "script.py", Lang: "go", LineNum: "1", Action: "comment"},
+			expected: "// a\n# START\nb\n# END\n",
+		},
+		{
+			name:     "DryRunJSON",
+			conf:     Config{Filename: StdinName, StdinFilename: "script.py", LineNum: "3", Action: "comment", DryRun: true, Format: FormatJSON},
+			expected: `{"file":"script.py","line":3,"before":"b","after":"# b"}` + "\n",
+		},
+		{
+			name:     "DryRunText",
+			conf:     Config{Filename: StdinName, Lang: "python", LineNum: "3", Action: "comment", DryRun: true},
+			expected: "3: b -> # b\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changeStdin(t, tt.conf, input); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestChangeRanges(t *testing.T) {
+	input := "a\r\n# START\r\nb\r\nc\r\n# END\r\nd"
+	tests := []struct {
+		name     string
+		conf     Config
+		expected string
+	}{
+		{
+			name:     "RangesAlone",
+			conf:     Config{Filename: "script.py", Action: "comment", Ranges: [][2]int{{1, 1}, {6, 6}}},
+			expected: "# a\r\n# START\r\nb\r\nc\r\n# END\r\n# d\n",
+		},
+		{
+			name:     "RangesNarrowLabels",
+			conf:     Config{Filename: "script.py", Action: "comment", StartLabel: "START", EndLabel: "END", Ranges: [][2]int{{1, 3}}},
+			expected: "a\r\n# START\r\n# b\r\nc\r\n# END\r\nd\n",
+		},
+		{
+			name:     "EmptyRanges",
+			conf:     Config{Filename: "script.py", Action: "comment", Ranges: [][2]int{}},
+			expected: "a\r\n# START\r\nb\r\nc\r\n# END\r\nd\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Change(strings.NewReader(input), &out, tt.conf); err != nil {
+				t.Fatalf("No error expected got: %s", err)
+			}
+			if out.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestIntersectRanges(t *testing.T) {
+	got := intersectRanges([][2]int{{1, 5}, {8, 10}}, [][2]int{{3, 9}})
+	expected := [][2]int{{3, 5}, {8, 9}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	tests := []struct {
+		name     string
+		after    string
+		context  int
+		expected string
+	}{
+		{name: "Equal", after: before, context: 3, expected: ""},
+		{
+			name:     "SeparateHunks",
+			after:    "// a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n// l\n",
+			context:  2,
+			expected: "--- f.go\n+++ f.go\n@@ -1,3 +1,3 @@\n-a\n+// a\n b\n c\n@@ -10,3 +10,3 @@\n j\n k\n-l\n+// l\n",
+		},
+		{
+			name:     "MergedHunks",
+			after:    "a\nb\n// c\nd\ne\n// f\ng\nh\ni\nj\nk\nl\n",
+			context:  1,
+			expected: "--- f.go\n+++ f.go\n@@ -2,6 +2,6 @@\n b\n-c\n+// c\n d\n e\n-f\n+// f\n g\n",
+		},
+		{
+			name:     "NoNewline",
+			after:    "x",
+			context:  3,
+			expected: "--- f.go\n+++ f.go\n@@ -1,12 +1,1 @@\n-a\n-b\n-c\n-d\n-e\n-f\n-g\n-h\n-i\n-j\n-k\n-l\n+x\n\\ No newline at end of file\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff("f.go", []byte(before), []byte(tt.after), tt.context); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package modfile
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrFileChanged is returned when a file was modified by someone else
+// between the moment tgcom read it and the moment it was about to be replaced.
+var ErrFileChanged = errors.New("file changed while it was being processed")
+
+// Snapshot records the state of a file, so that a later change to it can be
+// detected before tgcom overwrites it.
+type Snapshot struct {
+	Size    int64
+	ModTime time.Time
+	Hash    [sha256.Size]byte
+}
+
+// TakeSnapshot records the current size, modification time and content hash
+// of filename.
+func TakeSnapshot(filename string) (Snapshot, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer file.Close()
+	return snapshotOf(file)
+}
+
+// snapshotOf hashes the content of an open file, leaving its offset at the end.
+func snapshotOf(file *os.File) (Snapshot, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Snapshot{}, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return Snapshot{}, err
+	}
+	snapshot := Snapshot{Size: info.Size(), ModTime: info.ModTime()}
+	copy(snapshot.Hash[:], hash.Sum(nil))
+	return snapshot, nil
+}
+
+// Matches reports whether other describes the same content as s. The
+// modification time is not compared, so touching a file without changing
+// it does not count as a change.
+func (s Snapshot) Matches(other Snapshot) bool {
+	return s.Size == other.Size && s.Hash == other.Hash
+}
+
+// verifyUnchanged returns ErrFileChanged if the content of filename no
+// longer matches expected.
+func verifyUnchanged(filename string, expected Snapshot) error {
+	current, err := TakeSnapshot(filename)
+	if err != nil {
+		return err
+	}
+	if !expected.Matches(current) {
+		return fmt.Errorf("%s was modified at %s: %w", filename, current.ModTime.Format(time.TimeOnly), ErrFileChanged)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package modfile
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+
+	"github.com/dyne/tgcom/utils/commenter"
+)
+
+// Kinds of symbols that can be selected by name instead of by line numbers.
+const (
+	SymbolFunc  = "func"
+	SymbolType  = "type"
+	SymbolBlock = "block"
+)
+
+// funcPatterns match the first line of a function definition in most
+// languages. %s is replaced by the quoted function name.
+var funcPatterns = []string{
+	// Go, JavaScript, Python, Ruby, Rust, Kotlin, Swift, Perl, Lua, Elixir, PHP...
+	`\b(?:func|function|def|defp|fn|fun|sub)\s+(?:\([^)]*\)\s*)?%s\b`,
+	// JavaScript and TypeScript function expressions and arrow functions
+	`\b%s\s*[:=]\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*=>|\w+\s*=>)`,
+	// C, C++, Java, C#, Dart: return type followed by the name
+	`^\s*(?:[\w*&<>,:\[\]]+\s+)+[*&]?%s\s*\([^;]*$`,
+	// Methods in JavaScript and TypeScript classes
+	`^\s*(?:(?:public|private|protected|static|async|override|get|set)\s+)*%s\s*\([^;]*\)\s*(?::\s*[^{]+)?\{\s*$`,
+	// Erlang function clauses
+	`^%s\s*\(.*\)\s*(?:when\s.*)?->`,
+}
+
+// typePatterns match the first line of a type definition.
+var typePatterns = []string{
+	`\b(?:class|struct|interface|enum|trait|type|record|object|union|module|impl|protocol|entity)\s+%s\b`,
+}
+
+// notDefinition holds words that can precede a call on a line that would
+// otherwise look like a C-style function definition.
+var notDefinition = map[string]bool{
+	"return": true, "else": true, "new": true, "await": true, "throw": true,
+	"case": true, "delete": true, "yield": true, "go": true, "defer": true,
+}
+
+// findSymbol returns the range of lines of the function, type or block
+// called name in src. Go sources are parsed with go/parser; other languages,
+// and Go declarations that are commented out, are matched with patterns on
+// the uncommented text and extended to their closing brace or, for
+// indentation-based languages, to the end of the indented block.
+func findSymbol(src []byte, lang, commentChars, kind, name string) ([2]int, error) {
+	if name == "" {
+		return [2]int{0, 0}, fmt.Errorf("empty %s name", kind)
+	}
+
+	if lang == "go" || lang == "golang" {
+		if lines, ok, err := findGoSymbol(src, kind, name); ok || err != nil {
+			return lines, err
+		}
+	}
+
+	lines := uncommentedLines(src, commentChars)
+	what := kind + " " + name
+
+	// Type.Method looks for a Go method by its receiver, or for the method
+	// inside the body of the type in other languages
+	if kind == SymbolFunc && strings.Contains(name, ".") {
+		typeName, funcName, _ := strings.Cut(name, ".")
+		if lang == "go" || lang == "golang" {
+			method := fmt.Sprintf(`\bfunc\s+\([^)]*\b%s(?:\[[^\]]*\])?\)\s*%s\b`, regexp.QuoteMeta(typeName), regexp.QuoteMeta(funcName))
+			return findDefinition(lines, []*regexp.Regexp{regexp.MustCompile(method)}, what)
+		}
+		outer, err := findDefinition(lines, definitionPatterns(SymbolType, typeName), SymbolType+" "+typeName)
+		if err != nil {
+			return [2]int{0, 0}, err
+		}
+		inner, err := findDefinition(lines[outer[0]-1:outer[1]], definitionPatterns(kind, funcName), what)
+		if err != nil {
+			return [2]int{0, 0}, err
+		}
+		return [2]int{inner[0] + outer[0] - 1, inner[1] + outer[0] - 1}, nil
+	}
+
+	switch kind {
+	case SymbolFunc, SymbolType, SymbolBlock:
+		return findDefinition(lines, definitionPatterns(kind, name), what)
+	default:
+		return [2]int{0, 0}, fmt.Errorf("unknown symbol kind: %s", kind)
+	}
+}
+
+// definitionPatterns returns the regular expressions matching the first
+// line of the symbol. A block is found by the literal text of its first line.
+func definitionPatterns(kind, name string) []*regexp.Regexp {
+	patterns := funcPatterns
+	switch kind {
+	case SymbolType:
+		patterns = typePatterns
+	case SymbolBlock:
+		patterns = []string{"%s"}
+	}
+	regexps := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		regexps[i] = regexp.MustCompile(fmt.Sprintf(pattern, regexp.QuoteMeta(name)))
+	}
+	return regexps
+}
+
+// findDefinition returns the 1-based range of the single block whose first
+// line matches one of regexps.
+func findDefinition(lines []string, regexps []*regexp.Regexp, what string) ([2]int, error) {
+	var matches []int
+	for i, line := range lines {
+		if notDefinition[firstWord(line)] {
+			continue
+		}
+		for _, re := range regexps {
+			if re.MatchString(line) {
+				matches = append(matches, i)
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return [2]int{0, 0}, fmt.Errorf("%s not found", what)
+	case 1:
+		start := matches[0]
+		return [2]int{start + 1, blockEnd(lines, start) + 1}, nil
+	default:
+		found := make([]string, len(matches))
+		for i, match := range matches {
+			found[i] = fmt.Sprint(match + 1)
+		}
+		return [2]int{0, 0}, fmt.Errorf("%s is ambiguous: found at lines %s", what, strings.Join(found, ", "))
+	}
+}
+
+// findGoSymbol resolves functions, methods and types with go/parser. The
+// boolean is false when the symbol was not found, so that the caller can
+// fall back to the pattern based search, for example because the
+// declaration is commented out.
+func findGoSymbol(src []byte, kind, name string) ([2]int, bool, error) {
+	if kind != SymbolFunc && kind != SymbolType {
+		return [2]int{0, 0}, false, nil
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return [2]int{0, 0}, false, nil
+	}
+	lineRange := func(node ast.Node) [2]int {
+		return [2]int{fset.Position(node.Pos()).Line, fset.Position(node.End()).Line}
+	}
+
+	recvName, funcName, isMethod := strings.Cut(name, ".")
+	if !isMethod {
+		funcName, recvName = name, ""
+	}
+
+	var matches [][2]int
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if kind == SymbolFunc && d.Name.Name == funcName && (recvName == "" || receiverType(d) == recvName) {
+				matches = append(matches, lineRange(d))
+			}
+		case *ast.GenDecl:
+			if kind != SymbolType || d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				if spec.(*ast.TypeSpec).Name.Name != name {
+					continue
+				}
+				// A lone type declaration includes its type keyword
+				if d.Lparen.IsValid() {
+					matches = append(matches, lineRange(spec))
+				} else {
+					matches = append(matches, lineRange(d))
+				}
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return [2]int{0, 0}, false, nil
+	case 1:
+		return matches[0], true, nil
+	default:
+		return [2]int{0, 0}, true, fmt.Errorf("%s %s is ambiguous: use Type.Method to select a method", kind, name)
+	}
+}
+
+// receiverType returns the name of the receiver type of a method, without
+// pointer or type parameters.
+func receiverType(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return ""
+	}
+	expr := decl.Recv.List[0].Type
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// uncommentedLines splits src into lines with their leading comment marker
+// removed, so that commented-out code can be found again to uncomment it.
+func uncommentedLines(src []byte, commentChars string) []string {
+	lines := splitLines(src)
+	if commentChars != "" {
+		for i, line := range lines {
+			lines[i] = commenter.Uncomment(line, commentChars)
+		}
+	}
+	return lines
+}
+
+// blockEnd returns the index of the last line of the block starting at
+// lines[start]. Blocks that open a brace on their first line, or on the
+// next one, end at the matching closing brace; anything else is treated as
+// an indented block, which also covers Python, Ruby and Lua.
+func blockEnd(lines []string, start int) int {
+	opensBrace := strings.Contains(stripStrings(lines[start]), "{")
+	if !opensBrace && start+1 < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[start+1]), "{") {
+		opensBrace = true
+	}
+	if opensBrace {
+		if end, ok := braceEnd(lines, start); ok {
+			return end
+		}
+	}
+	return indentEnd(lines, start)
+}
+
+// braceEnd finds the line where the first brace opened at or after
+// lines[start] is closed.
+func braceEnd(lines []string, start int) (int, bool) {
+	depth := 0
+	opened := false
+	for i := start; i < len(lines); i++ {
+		for _, r := range stripStrings(lines[i]) {
+			switch r {
+			case '{':
+				depth++
+				opened = true
+			case '}':
+				depth--
+			}
+			if opened && depth == 0 {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// indentEnd returns the last line of the block indented below lines[start].
+// A closing keyword such as "end" at the indentation of the first line is
+// part of the block.
+func indentEnd(lines []string, start int) int {
+	base := indentation(lines[start])
+	end := start
+	for i := start + 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			continue
+		}
+		if indentation(lines[i]) <= base {
+			word := firstWord(lines[i])
+			if strings.HasPrefix(word, "end") {
+				end = i
+			}
+			break
+		}
+		end = i
+	}
+	return end
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+func firstWord(line string) string {
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// stripStrings blanks out the content of string and character literals, so
+// that braces inside them are not counted.
+func stripStrings(line string) string {
+	var b strings.Builder
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case quote == 0 && (r == '"' || r == '\'' || r == '`'):
+			quote = r
+		case quote != 0 && escaped:
+			escaped = false
+			continue
+		case quote != 0 && r == '\\':
+			escaped = true
+			continue
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
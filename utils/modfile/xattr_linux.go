@@ -0,0 +1,59 @@
+package modfile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs copies the extended attributes of src to dst. Attributes the
+// filesystem does not support, or that the current user may not set (for
+// example in the trusted namespace), are skipped.
+func copyXattrs(src, dst *os.File) error {
+	size, err := unix.Flistxattr(int(src.Fd()), nil)
+	if err != nil || size == 0 {
+		return ignoreXattrErr(err)
+	}
+	list := make([]byte, size)
+	size, err = unix.Flistxattr(int(src.Fd()), list)
+	if err != nil {
+		return ignoreXattrErr(err)
+	}
+
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+		valueSize, err := unix.Fgetxattr(int(src.Fd()), attr, nil)
+		if err != nil {
+			if err := ignoreXattrErr(err); err != nil {
+				return err
+			}
+			continue
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Fgetxattr(int(src.Fd()), attr, value)
+		if err != nil {
+			if err := ignoreXattrErr(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := unix.Fsetxattr(int(dst.Fd()), attr, value[:valueSize], 0); err != nil {
+			if err := ignoreXattrErr(err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func ignoreXattrErr(err error) error {
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) || errors.Is(err, unix.ENODATA) {
+		return nil
+	}
+	return err
+}
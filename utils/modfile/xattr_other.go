@@ -0,0 +1,11 @@
+//go:build !linux
+
+package modfile
+
+import "os"
+
+// copyXattrs is only implemented on Linux; elsewhere extended attributes
+// are not carried over to the rewritten file.
+func copyXattrs(src, dst *os.File) error {
+	return nil
+}
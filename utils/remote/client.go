@@ -0,0 +1,241 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/dyne/tgcom/utils/modfile"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxLinks is how many symbolic links are followed before giving up.
+const maxLinks = 40
+
+// ErrUnsupported is returned for the options of modfile.Config that need the
+// files to be local.
+var ErrUnsupported = errors.New("not supported on remote files")
+
+// Client reads and changes the files of a host over SFTP.
+type Client struct {
+	Dir  string // Directory of relative paths
+	conn *ssh.Client
+	sftp *sftp.Client
+}
+
+// Connect connects to host with Dial and opens an SFTP session in which
+// relative paths are in dir.
+func Connect(user, host string, port int, dir string) (*Client, error) {
+	conn, err := Dial(user, host, port)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClient(conn, dir)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient opens an SFTP session over conn, in which relative paths are in
+// dir. A relative dir is in the home directory of the user, and Dir is set
+// to its absolute path. Closing the client closes conn.
+func NewClient(conn *ssh.Client, dir string) (*Client, error) {
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start SFTP, is it enabled on the server? %w", err)
+	}
+	if dir == "" {
+		dir = "."
+	}
+	if !path.IsAbs(dir) {
+		if dir, err = client.RealPath(dir); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return &Client{Dir: dir, conn: conn, sftp: client}, nil
+}
+
+// Close ends the SFTP session and the connection.
+func (c *Client) Close() error {
+	c.sftp.Close()
+	return c.conn.Close()
+}
+
+// path returns the path of name on the host.
+func (c *Client) path(name string) string {
+	if path.IsAbs(name) || c.Dir == "" {
+		return name
+	}
+	return path.Join(c.Dir, name)
+}
+
+// ReadDir returns the entries of dir, without following symbolic links.
+func (c *Client) ReadDir(dir string) ([]fs.FileInfo, error) {
+	return c.sftp.ReadDir(c.path(dir))
+}
+
+// Stat returns the information of name, following symbolic links.
+func (c *Client) Stat(name string) (fs.FileInfo, error) {
+	return c.sftp.Stat(c.path(name))
+}
+
+// Open opens name for reading.
+func (c *Client) Open(name string) (io.ReadCloser, error) {
+	return c.sftp.Open(c.path(name))
+}
+
+// ReadFile returns the content of name.
+func (c *Client) ReadFile(name string) ([]byte, error) {
+	content, _, err := c.read(c.path(name))
+	return content, err
+}
+
+// TakeSnapshot is modfile.TakeSnapshot for a file of the host.
+func (c *Client) TakeSnapshot(name string) (modfile.Snapshot, error) {
+	content, info, err := c.read(c.path(name))
+	if err != nil {
+		return modfile.Snapshot{}, err
+	}
+	return snapshotOf(content, info), nil
+}
+
+// ChangeFile is modfile.ChangeFile for a file of the host. The file is
+// read, changed locally and written to a temporary file next to it, which
+// replaces it once complete, so the file has either the old or the new
+// content at any time. The temporary file gets the mode and, where
+// permitted, the owner of the original, and symlinks are followed unless
+// conf.NoFollow is set. Backups and the selection of lines changed in git
+// are not supported.
+func (c *Client) ChangeFile(conf modfile.Config) error {
+	if conf.Filename == "" || conf.Filename == modfile.StdinName {
+		return modfile.ChangeFile(conf)
+	}
+	if conf.GitDiff != "" || conf.Staged || conf.Unstaged {
+		return fmt.Errorf("selecting lines changed in git is %w", ErrUnsupported)
+	}
+	if conf.Backup != "" && conf.Backup != modfile.BackupNone {
+		return fmt.Errorf("backups are %w", ErrUnsupported)
+	}
+
+	target := c.path(conf.Filename)
+	if !conf.NoFollow {
+		var err error
+		if target, err = c.resolve(target); err != nil {
+			return err
+		}
+	}
+	content, info, err := c.read(target)
+	if err != nil {
+		return err
+	}
+	if conf.Expect != nil && !conf.Expect.Matches(snapshotOf(content, info)) {
+		return fmt.Errorf("%s changed since it was selected: %w", conf.Filename, modfile.ErrFileChanged)
+	}
+
+	if conf.DryRun {
+		return modfile.Change(bytes.NewReader(content), os.Stdout, conf)
+	}
+	var output bytes.Buffer
+	if err := modfile.Change(bytes.NewReader(content), &output, conf); err != nil {
+		return err
+	}
+	return c.replace(target, info, content, output.Bytes())
+}
+
+// read returns the content and the information of the file at name.
+func (c *Client) read(name string) ([]byte, fs.FileInfo, error) {
+	file, err := c.sftp.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, info, nil
+}
+
+// resolve follows the symbolic links of name until a file that is not one.
+func (c *Client) resolve(name string) (string, error) {
+	for i := 0; i < maxLinks; i++ {
+		info, err := c.sftp.Lstat(name)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return name, nil
+		}
+		link, err := c.sftp.ReadLink(name)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(link) {
+			link = path.Join(path.Dir(name), link)
+		}
+		name = link
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+}
+
+// replace writes content to a temporary file next to target and renames it
+// over target, unless target no longer holds before.
+func (c *Client) replace(target string, info fs.FileInfo, before, content []byte) error {
+	tmpFilename := path.Join(path.Dir(target), "."+path.Base(target)+"."+strconv.FormatUint(rand.Uint64(), 10)+".tmp")
+	tmpFile, err := c.sftp.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	defer c.sftp.Remove(tmpFilename)
+	defer tmpFile.Close()
+
+	// Chown before chmod: changing the owner clears the setuid and setgid
+	// bits. Only root can give a file away, so failing is expected.
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		_ = tmpFile.Chown(int(stat.UID), int(stat.GID))
+	}
+	if err := tmpFile.Chmod(info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)); err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(content); err != nil {
+		return err
+	}
+	// Not every server can flush files to disk
+	var status *sftp.StatusError
+	if err := tmpFile.Sync(); err != nil && !(errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported) {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	// An editor may have saved the file while we were processing it
+	current, _, err := c.read(target)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, before) {
+		return fmt.Errorf("%s: %w", target, modfile.ErrFileChanged)
+	}
+	return c.sftp.PosixRename(tmpFilename, target)
+}
+
+// snapshotOf returns the snapshot of a file with content and info.
+func snapshotOf(content []byte, info fs.FileInfo) modfile.Snapshot {
+	return modfile.Snapshot{Size: info.Size(), ModTime: info.ModTime(), Hash: sha256.Sum256(content)}
+}
@@ -0,0 +1,280 @@
+// Package remote edits the files of another host over SSH and SFTP, without
+// tgcom running there. Connections are configured like those of ssh, from
+// ~/.ssh/config, the SSH agent and the known hosts files.
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultPort is the port of SSH servers when none is configured.
+const DefaultPort = 22
+
+// systemConfig is the configuration file of the host, read after the one of
+// the user.
+var systemConfig = "/etc/ssh/ssh_config"
+
+// defaultIdentityFiles are the keys tried when the configuration names none.
+var defaultIdentityFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// sshConfig holds the configuration files of ssh, the first one taking
+// precedence.
+type sshConfig []*ssh_config.Config
+
+// loadSSHConfig reads ~/.ssh/config in home and the system configuration,
+// skipping those that do not exist.
+func loadSSHConfig(home string) (sshConfig, error) {
+	var configs sshConfig
+	for _, path := range []string{filepath.Join(home, ".ssh", "config"), systemConfig} {
+		if path == "" {
+			continue
+		}
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := ssh_config.Decode(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// getAll returns the values of key for host in the first configuration
+// that sets it.
+func (c sshConfig) getAll(host, key string) (values []string, err error) {
+	// ssh_config panics on the Match directives it does not support
+	defer func() {
+		if r := recover(); r != nil {
+			values, err = nil, fmt.Errorf("cannot read the ssh configuration: %v", r)
+		}
+	}()
+	for _, cfg := range c {
+		values, err := cfg.GetAll(host, key)
+		if err != nil || len(values) > 0 {
+			return values, err
+		}
+	}
+	return nil, nil
+}
+
+// get returns the first value of key for host, or "".
+func (c sshConfig) get(host, key string) (string, error) {
+	values, err := c.getAll(host, key)
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// Dial connects to the SSH server of host the way ssh does: HostName, User,
+// Port, IdentityFile and UserKnownHostsFile are read from the ssh
+// configuration, the keys of the SSH agent and of the identity files are
+// offered, and the host key must be in the known hosts files. user and port
+// override the configuration unless they are empty.
+func Dial(user, host string, port int) (*ssh.Client, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadSSHConfig(home)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := cfg.get(host, "HostName")
+	if err != nil {
+		return nil, err
+	}
+	if hostname == "" {
+		hostname = host
+	}
+	if user == "" {
+		if user, err = cfg.get(host, "User"); err != nil {
+			return nil, err
+		}
+	}
+	if user == "" {
+		user = currentUser()
+	}
+	if port == 0 {
+		if port, err = configPort(cfg, host); err != nil {
+			return nil, err
+		}
+	}
+	identityFiles, err := cfg.getAll(host, "IdentityFile")
+	if err != nil {
+		return nil, err
+	}
+	if len(identityFiles) == 0 {
+		identityFiles = defaultIdentityFiles
+	}
+	knownHostsFiles, err := cfg.get(host, "UserKnownHostsFile")
+	if err != nil {
+		return nil, err
+	}
+	if knownHostsFiles == "" {
+		knownHostsFiles = "~/.ssh/known_hosts"
+	}
+
+	address := net.JoinHostPort(hostname, strconv.Itoa(port))
+	hostKeyCallback, knownFiles, err := knownHosts(expandHome(home, strings.Fields(knownHostsFiles)))
+	if err != nil {
+		return nil, err
+	}
+	auth, closeAgent := authMethods(expandHome(home, identityFiles))
+	defer closeAgent()
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeyCallback, address),
+	})
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("the host key of %s is unknown: connect to it once with ssh to add it to %s", address, strings.Join(knownFiles, ", "))
+		}
+		return nil, fmt.Errorf("the host key of %s does not match the one in %s:%d: someone may be intercepting the connection", address, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", address, err)
+	}
+	return client, nil
+}
+
+// configPort returns the port of host in the ssh configuration, or
+// DefaultPort.
+func configPort(cfg sshConfig, host string) (int, error) {
+	value, err := cfg.get(host, "Port")
+	if err != nil || value == "" {
+		return DefaultPort, err
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %s for %s in the ssh configuration", value, host)
+	}
+	return port, nil
+}
+
+// currentUser returns the name of the local user, the default user name on
+// the remote host.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// expandHome replaces the leading ~ of paths with home.
+func expandHome(home string, paths []string) []string {
+	expanded := make([]string, len(paths))
+	for i, path := range paths {
+		if path == "~" || strings.HasPrefix(path, "~/") {
+			path = filepath.Join(home, path[1:])
+		}
+		expanded[i] = path
+	}
+	return expanded
+}
+
+// knownHosts returns the callback checking host keys against those of
+// files, and the files that were found. A missing file knows no host.
+func knownHosts(files []string) (ssh.HostKeyCallback, []string, error) {
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	callback, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(existing) == 0 {
+		existing = files
+	}
+	return callback, existing, nil
+}
+
+// placeholderKey is a host key that is never known, so that checking it
+// returns the keys that are.
+type placeholderKey struct{}
+
+func (placeholderKey) Type() string    { return "placeholder" }
+func (placeholderKey) Marshal() []byte { return []byte("placeholder") }
+func (placeholderKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("placeholder key")
+}
+
+// hostKeyAlgorithms returns the algorithms of the keys known for address,
+// so that the server presents one of those rather than another kind of key
+// that would be reported as unknown. It returns nil, any algorithm, when no
+// key is known.
+func hostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	var keyErr *knownhosts.KeyError
+	if err := callback(address, &net.TCPAddr{IP: net.IPv4zero}, placeholderKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch keyType := known.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, keyType)
+		}
+	}
+	return algorithms
+}
+
+// authMethods returns the keys of the SSH agent, if there is one, and of
+// the identity files that exist and are not encrypted, as those are
+// expected to be in the agent. The returned function closes the connection
+// to the agent.
+func authMethods(identityFiles []string) ([]ssh.AuthMethod, func()) {
+	var methods []ssh.AuthMethod
+	closeAgent := func() {}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closeAgent = func() { conn.Close() }
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, file := range identityFiles {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods, closeAgent
+}
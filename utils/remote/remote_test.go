@@ -0,0 +1,286 @@
+package remote
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/dyne/tgcom/utils/modfile"
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newKey returns a new ed25519 private key and its signer.
+func newKey(t *testing.T) (ed25519.PrivateKey, gossh.Signer) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, signer
+}
+
+// serve starts an SSH server with SFTP accepting clientKey, running handler
+// for other sessions, and returns its address and host key. The name of the
+// user of the last connection is sent to users.
+func serve(t *testing.T, clientKey gossh.PublicKey, users chan<- string, handler ssh.Handler) (string, gossh.PublicKey) {
+	t.Helper()
+	_, hostSigner := newKey(t)
+	srv := &ssh.Server{
+		Handler: handler,
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return ssh.KeysEqual(key, clientKey)
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": func(s ssh.Session) {
+				select {
+				case users <- s.User():
+				default:
+				}
+				server, err := sftp.NewServer(s)
+				if err != nil {
+					return
+				}
+				server.Serve()
+			},
+		},
+	}
+	srv.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return listener.Addr().String(), hostSigner.PublicKey()
+}
+
+// setup makes a home directory in which the host "box" is the server at
+// address, and returns the path of its .ssh directory.
+func setup(t *testing.T, address string) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	original := systemConfig
+	systemConfig = ""
+	t.Cleanup(func() { systemConfig = original })
+
+	dir := filepath.Join(home, ".ssh")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(address)
+	config := "Host box\n  HostName " + host + "\n  Port " + port + "\n  User alice\n  IdentityFile ~/.ssh/key\n"
+	if err := os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeKey writes private to path in the OpenSSH format.
+func writeKey(t *testing.T, path string, private ed25519.PrivateKey) {
+	t.Helper()
+	block, err := gossh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	private, signer := newKey(t)
+	users := make(chan string, 1)
+	address, hostKey := serve(t, signer.PublicKey(), users, nil)
+	dir := setup(t, address)
+	writeKey(t, filepath.Join(dir, "key"), private)
+
+	_, err := Dial("", "box", 0)
+	if err == nil || !strings.Contains(err.Error(), "is unknown") {
+		t.Errorf("expected an unknown host key error, got %v", err)
+	}
+
+	_, otherKey := newKey(t)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, otherKey.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Dial("", "box", 0)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a host key mismatch, got %v", err)
+	}
+
+	line = knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey)
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial("", "box", 0)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	client, err := NewClient(conn, "/")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	client.Close()
+	if user := <-users; user != "alice" {
+		t.Errorf("expected the user of the configuration, got %s", user)
+	}
+
+	// Keys of the agent are offered when there is no identity file
+	if err := os.Remove(filepath.Join(dir, "key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Dial("bob", "box", 0); err == nil {
+		t.Errorf("expected an error without keys")
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: private}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	conn, err = Dial("bob", "box", 0)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	client, err = NewClient(conn, "/")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	client.Close()
+	if user := <-users; user != "bob" {
+		t.Errorf("expected the given user, got %s", user)
+	}
+}
+
+// dial returns a connection to a server on the local host running handler
+// for sessions other than SFTP.
+func dial(t *testing.T, handler ssh.Handler) *gossh.Client {
+	t.Helper()
+	private, signer := newKey(t)
+	address, hostKey := serve(t, signer.PublicKey(), nil, handler)
+	sshDir := setup(t, address)
+	writeKey(t, filepath.Join(sshDir, "key"), private)
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey)
+	if err := os.WriteFile(filepath.Join(sshDir, "known_hosts"), []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial("", "box", 0)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connect returns a client of a server on the local host, in dir.
+func connect(t *testing.T, dir string) *Client {
+	t.Helper()
+	client, err := NewClient(dial(t, nil), dir)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestChangeFile(t *testing.T) {
+	dir := t.TempDir()
+	client := connect(t, dir)
+	path := filepath.Join(dir, "main.go")
+	content := "package main\n\nfunc main() {\n\tprintln(1)\n}\n"
+	if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("main.go", filepath.Join(dir, "link.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := client.ReadDir(".")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(entries))
+	}
+
+	snapshot, err := client.TakeSnapshot("main.go")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if local, _ := modfile.TakeSnapshot(path); !snapshot.Matches(local) {
+		t.Errorf("snapshot %+v does not match the local one %+v", snapshot, local)
+	}
+
+	// Relative paths are in the directory of the client, and links are followed
+	if err := client.ChangeFile(modfile.Config{Filename: "link.go", LineNum: "4", Action: "comment", Expect: &snapshot}); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	want := "package main\n\nfunc main() {\n// \tprintln(1)\n}\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected the mode to be kept, got %v", info.Mode())
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "link.go")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected link.go to remain a link")
+	}
+
+	// The file changed since the snapshot was taken
+	err = client.ChangeFile(modfile.Config{Filename: path, LineNum: "4", Action: "uncomment", Expect: &snapshot})
+	if !errors.Is(err, modfile.ErrFileChanged) {
+		t.Errorf("expected ErrFileChanged, got %v", err)
+	}
+
+	err = client.ChangeFile(modfile.Config{Filename: path, LineNum: "4", GitDiff: "HEAD"})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+
+	if err := client.ChangeFile(modfile.Config{Filename: "link.go", LineNum: "4", Action: "uncomment", NoFollow: true}); err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "link.go")); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("expected link.go to be replaced")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "link.go")); string(got) != content {
+		t.Errorf("expected %q, got %q", content, got)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, ".*.tmp"))
+	if len(files) != 0 {
+		t.Errorf("temporary files left behind: %v", files)
+	}
+}
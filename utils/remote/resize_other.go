@@ -0,0 +1,39 @@
+//go:build !unix
+
+package remote
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// resizeInterval is how often the size of the terminal is checked where
+// there is no signal for its changes.
+const resizeInterval = 500 * time.Millisecond
+
+// forwardResize sends the size of the terminal fd to session whenever it
+// changes, until the returned function is called.
+func forwardResize(fd int, session *ssh.Session) func() {
+	ticker := time.NewTicker(resizeInterval)
+	done := make(chan struct{})
+	go func() {
+		width, height, _ := term.GetSize(fd)
+		for {
+			select {
+			case <-ticker.C:
+				if w, h, err := term.GetSize(fd); err == nil && (w != width || h != height) {
+					width, height = w, h
+					session.WindowChange(height, width)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
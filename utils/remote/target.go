@@ -0,0 +1,188 @@
+package remote
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// targetUsage is the accepted forms of remote targets, given in errors.
+const targetUsage = "use [user@]host:/path or ssh://[user@]host[:port]/path"
+
+// Target is a directory of a remote host.
+type Target struct {
+	User string // Empty to use the one of the ssh configuration
+	Host string // Host name, alias of the ssh configuration or IP address
+	Port int    // 0 to use the one of the ssh configuration
+	Dir  string // Empty for the home directory of the user
+}
+
+// ParseTarget parses a remote target in the scp form [user@]host:path, or as
+// a ssh://[user@]host[:port][/path] URI. IPv6 addresses are written in
+// brackets, such as [::1]:/srv or ssh://[::1]:2222/srv. In URIs, a path
+// starting with /~/ is relative to the home directory.
+func ParseTarget(target string) (Target, error) {
+	if target == "" {
+		return Target{}, fmt.Errorf("empty remote target: %s", targetUsage)
+	}
+	if scheme, rest, ok := strings.Cut(target, "://"); ok && !strings.ContainsAny(scheme, "/@:[") {
+		if !strings.EqualFold(scheme, "ssh") {
+			return Target{}, fmt.Errorf("unsupported scheme %s in %s: %s", scheme, target, targetUsage)
+		}
+		return parseURI(target, rest)
+	}
+	return parseSCP(target)
+}
+
+// parseURI parses rest, the part of the URI target after ssh://.
+func parseURI(target, rest string) (Target, error) {
+	authority, dir := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		authority, dir = rest[:i], rest[i:]
+	}
+	if strings.ContainsAny(dir, "?#") {
+		return Target{}, fmt.Errorf("invalid path %s in %s: queries and fragments are not supported", dir, target)
+	}
+	dir, err := url.PathUnescape(dir)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid path %s in %s: %w", rest[len(authority):], target, err)
+	}
+	if dir == "/~" || strings.HasPrefix(dir, "/~/") {
+		dir = strings.TrimPrefix(strings.TrimPrefix(dir, "/~"), "/")
+	}
+
+	t := Target{Dir: dir}
+	hostPort := authority
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		if t.User, err = parseUser(target, authority[:i], true); err != nil {
+			return Target{}, err
+		}
+		hostPort = authority[i+1:]
+	}
+	host, port, err := splitHost(target, hostPort)
+	if err != nil {
+		return Target{}, err
+	}
+	if strings.Contains(port, ":") {
+		return Target{}, fmt.Errorf("invalid host %s in %s: IPv6 addresses must be in brackets, such as [::1]", hostPort, target)
+	}
+	if t.Host, err = checkHost(target, host); err != nil {
+		return Target{}, err
+	}
+	if port != "" {
+		if t.Port, err = parsePort(target, port); err != nil {
+			return Target{}, err
+		}
+	}
+	return t, nil
+}
+
+// parseSCP parses target in the scp form [user@]host:path. The host ends
+// at the first colon out of brackets, so the path can contain any character.
+func parseSCP(target string) (Target, error) {
+	colon, inBrackets := -1, false
+	for i, c := range target {
+		if c == '[' {
+			inBrackets = true
+		} else if c == ']' {
+			inBrackets = false
+		} else if c == ':' && !inBrackets {
+			colon = i
+			break
+		} else if c == '/' && !inBrackets {
+			break
+		}
+	}
+	if inBrackets {
+		return Target{}, fmt.Errorf("missing ] after the IPv6 address in %s", target)
+	}
+	if colon < 0 {
+		return Target{}, fmt.Errorf("missing : between the host and the directory in %s: %s", target, targetUsage)
+	}
+
+	t := Target{Dir: target[colon+1:]}
+	host := target[:colon]
+	var err error
+	if i := strings.LastIndexByte(host, '@'); i >= 0 {
+		if t.User, err = parseUser(target, host[:i], false); err != nil {
+			return Target{}, err
+		}
+		host = host[i+1:]
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if t.Host, err = checkHost(target, host); err != nil {
+		return Target{}, err
+	}
+	return t, nil
+}
+
+// splitHost splits hostPort into a host, without brackets, and a port.
+func splitHost(target, hostPort string) (string, string, error) {
+	if !strings.HasPrefix(hostPort, "[") {
+		host, port, _ := strings.Cut(hostPort, ":")
+		if port == "" && strings.HasSuffix(hostPort, ":") {
+			return "", "", fmt.Errorf("empty port in %s", target)
+		}
+		return host, port, nil
+	}
+	end := strings.IndexByte(hostPort, ']')
+	if end < 0 {
+		return "", "", fmt.Errorf("missing ] after the IPv6 address in %s", target)
+	}
+	host, rest := hostPort[1:end], hostPort[end+1:]
+	if rest == "" {
+		return host, "", nil
+	}
+	if rest == ":" {
+		return "", "", fmt.Errorf("empty port in %s", target)
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return "", "", fmt.Errorf("invalid host %s in %s: expected : and a port after ]", hostPort, target)
+	}
+	return host, rest[1:], nil
+}
+
+// parseUser checks the user of target, decoding it if escaped is set.
+func parseUser(target, user string, escaped bool) (string, error) {
+	if escaped {
+		decoded, err := url.PathUnescape(user)
+		if err != nil {
+			return "", fmt.Errorf("invalid user %s in %s: %w", user, target, err)
+		}
+		user = decoded
+	}
+	switch {
+	case user == "":
+		return "", fmt.Errorf("empty user before @ in %s", target)
+	case strings.HasPrefix(user, "-"):
+		return "", fmt.Errorf("invalid user %s in %s: it cannot start with -", user, target)
+	case strings.ContainsAny(user, " \t\n/:"):
+		return "", fmt.Errorf("invalid user %s in %s: it cannot contain spaces, / or :", user, target)
+	}
+	return user, nil
+}
+
+// checkHost checks the host of target.
+func checkHost(target, host string) (string, error) {
+	switch {
+	case host == "":
+		return "", fmt.Errorf("missing host in %s: %s", target, targetUsage)
+	case strings.HasPrefix(host, "-"):
+		return "", fmt.Errorf("invalid host %s in %s: it cannot start with -", host, target)
+	case strings.ContainsAny(host, " \t\n/@[]"):
+		return "", fmt.Errorf("invalid host %s in %s: it cannot contain spaces, /, @ or brackets", host, target)
+	}
+	return host, nil
+}
+
+// parsePort checks the port of target.
+func parsePort(target, port string) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %s in %s: it must be a number from 1 to 65535", port, target)
+	}
+	return n, nil
+}
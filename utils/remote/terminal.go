@@ -0,0 +1,72 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// defaultTerm is the terminal type requested when TERM is not set.
+const defaultTerm = "xterm-256color"
+
+// RunTerminal runs command on conn in a session with a terminal, connected
+// to the local terminal in and to out. in is put in raw mode meanwhile, and
+// changes of its size are forwarded. The exit status of command is returned
+// as an *ssh.ExitError.
+func RunTerminal(conn *ssh.Client, command string, in *os.File, out io.Writer) error {
+	fd := int(in.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("a terminal is needed to open the remote TUI")
+	}
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		return fmt.Errorf("cannot get the size of the terminal: %w", err)
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return fmt.Errorf("cannot open a session: %w", err)
+	}
+	defer session.Close()
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = defaultTerm
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := session.RequestPty(termType, height, width, modes); err != nil {
+		return fmt.Errorf("cannot request a terminal: %w", err)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("cannot make the terminal raw: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	session.Stdin = in
+	session.Stdout = out
+	session.Stderr = out
+	if err := session.Start(command); err != nil {
+		return fmt.Errorf("cannot run %s: %w", command, err)
+	}
+	stop := forwardResize(fd, session)
+	defer stop()
+
+	err = session.Wait()
+	var missing *ssh.ExitMissingError
+	if errors.As(err, &missing) {
+		return errors.New("the connection was closed before the remote command exited")
+	}
+	return err
+}
+
+// Quote quotes arg for the shell-like splitting of commands done by SSH
+// servers.
+func Quote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
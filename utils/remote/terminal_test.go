@@ -0,0 +1,124 @@
+//go:build unix
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/creack/pty"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor waits until out contains want.
+func waitFor(t *testing.T, out *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q in the output, got %q", want, out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunTerminal(t *testing.T) {
+	conn := dial(t, func(s ssh.Session) {
+		ptyReq, windows, ok := s.Pty()
+		if !ok {
+			fmt.Fprintln(s.Stderr(), "no terminal")
+			s.Exit(1)
+			return
+		}
+		<-windows
+		fmt.Fprintf(s, "command=%s term=%s size=%dx%d\n", strings.Join(s.Command(), "|"), ptyReq.Term, ptyReq.Window.Width, ptyReq.Window.Height)
+		window := <-windows
+		fmt.Fprintf(s, "resized=%dx%d\n", window.Width, window.Height)
+		s.Exit(3)
+	})
+
+	// A file that is not a terminal is refused
+	file, err := os.CreateTemp(t.TempDir(), "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := RunTerminal(conn, "tgcom .", file, os.Stdout); err == nil {
+		t.Errorf("expected an error without a terminal")
+	}
+
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("cannot open a terminal: %s", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	if err := pty.Setsize(ptmx, &pty.Winsize{Rows: 24, Cols: 80}); err != nil {
+		t.Fatal(err)
+	}
+	var out syncBuffer
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := ptmx.Read(buf)
+			out.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	t.Setenv("TERM", "vt100")
+
+	done := make(chan error, 1)
+	go func() { done <- RunTerminal(conn, "tgcom "+Quote("/srv/it's here"), tty, tty) }()
+	waitFor(t, &out, "command=tgcom|/srv/it's here term=vt100 size=80x24")
+
+	// The test is not the foreground process of the terminal, so the
+	// change of size is signalled by hand, until the signal is watched
+	if err := pty.Setsize(ptmx, &pty.Winsize{Rows: 30, Cols: 100}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !strings.Contains(out.String(), "resized=") && i < 100; i++ {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGWINCH); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	waitFor(t, &out, "resized=100x30")
+
+	select {
+	case err := <-done:
+		var exitErr *gossh.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+			t.Errorf("expected the exit status 3, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunTerminal did not return after the command exited")
+	}
+}
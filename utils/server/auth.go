@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// Key is an authorized public key with the restrictions of the sessions
+// opened with it.
+type Key struct {
+	PublicKey ssh.PublicKey
+	Comment   string
+	Root      string // If set, only this directory and its subdirectories can be opened
+	ReadOnly  bool   // Files cannot be modified
+}
+
+// LoadAuthorizedKeys reads an authorized_keys file. Besides the keys, lines
+// can hold the options root="/path" and read-only, separated by commas,
+// before the key type. Other options are rejected rather than ignored, so
+// that a restriction meant for OpenSSH is never silently lifted.
+func LoadAuthorizedKeys(path string) ([]Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		publicKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		key := Key{PublicKey: publicKey, Comment: comment}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			switch name {
+			case "root":
+				root, err := strconv.Unquote(value)
+				if err != nil || !filepath.IsAbs(root) {
+					return nil, fmt.Errorf("%s:%d: root must be a quoted absolute path: %s", path, n, value)
+				}
+				key.Root = filepath.Clean(root)
+			case "read-only":
+				key.ReadOnly = true
+			default:
+				return nil, fmt.Errorf("%s:%d: unsupported option %q", path, n, option)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// publicKeyHandler accepts the connections authenticated with one of keys.
+// Clients can query several keys before authenticating with one of them, so
+// the key of a session is looked up by sessionKey and not recorded here.
+func publicKeyHandler(keys []Key) ssh.PublicKeyHandler {
+	return func(ctx ssh.Context, publicKey ssh.PublicKey) bool {
+		return findKey(keys, publicKey) != nil
+	}
+}
+
+// findKey returns the key of keys equal to publicKey, or nil.
+func findKey(keys []Key, publicKey ssh.PublicKey) *Key {
+	if publicKey == nil {
+		return nil
+	}
+	for i := range keys {
+		if ssh.KeysEqual(publicKey, keys[i].PublicKey) {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// sessionKey returns the key of keys s was authenticated with, or nil when
+// the server accepts any connection.
+func sessionKey(s ssh.Session, keys []Key) *Key {
+	return findKey(keys, s.PublicKey())
+}
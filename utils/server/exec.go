@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/dyne/tgcom/utils/audit"
+)
+
+// Environment variables telling tgcom that it runs the command of a session,
+// and the restrictions of the session it has to enforce.
+const (
+	EnvExec         = "TGCOM_EXEC"           // set to 1 for the commands of sessions
+	EnvExecRoots    = "TGCOM_EXEC_ROOTS"     // directories that can be accessed, separated by os.PathListSeparator
+	EnvExecReadOnly = "TGCOM_EXEC_READ_ONLY" // set to 1 when files cannot be modified
+
+	// The audit log of the changes made by the command, and the client it
+	// makes them for
+	EnvExecAuditLog     = "TGCOM_EXEC_AUDIT_LOG"
+	EnvExecAuditMaxSize = "TGCOM_EXEC_AUDIT_MAX_SIZE"
+	EnvExecAuditBackups = "TGCOM_EXEC_AUDIT_BACKUPS"
+	EnvExecUser         = "TGCOM_EXEC_USER"
+	EnvExecKey          = "TGCOM_EXEC_KEY"
+	EnvExecKeyComment   = "TGCOM_EXEC_KEY_COMMENT"
+	EnvExecRemote       = "TGCOM_EXEC_REMOTE"
+)
+
+// execCommand returns the command running tgcom with args.
+var execCommand = func(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.CommandContext(ctx, executable, args...), nil
+}
+
+// execMiddleware runs the tgcom command of sessions without a terminal, and
+// returns its output and exit status, so that scripts can use the server
+// without a PTY. The command records its changes in auditLog, and cannot
+// make any with readOnly or a read-only key of keys. Sessions with a
+// terminal are passed on to next.
+func execMiddleware(roots []string, keys []Key, readOnly bool, auditLog *audit.Logger) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(s ssh.Session) {
+			command := s.Command()
+			if _, _, isPty := s.Pty(); isPty || len(command) == 0 {
+				next(s)
+				return
+			}
+			if command[0] != "tgcom" {
+				wish.Fatalf(s, "unknown command %s: only tgcom can be run\n", command[0])
+				return
+			}
+
+			key := sessionKey(s, keys)
+			allowed := allowedRoots(roots, key)
+			c, err := execCommand(s.Context(), command[1:]...)
+			if err != nil {
+				wish.Fatalln(s, err)
+				return
+			}
+			auditor := audit.Auditor{Log: auditLog, Client: auditClient(s, key)}
+			c.Env = execEnv(os.Environ(), allowed, readOnly || key != nil && key.ReadOnly, auditor)
+			// Relative paths are in the first allowed directory
+			if len(allowed) > 0 {
+				c.Dir = allowed[0]
+			}
+			c.Stdout = s
+			c.Stderr = s.Stderr()
+			// The client may never close stdin, so it is not waited for
+			stdin, err := c.StdinPipe()
+			if err != nil {
+				wish.Fatalln(s, err)
+				return
+			}
+			if err := c.Start(); err != nil {
+				wish.Fatalln(s, err)
+				return
+			}
+			go func() {
+				io.Copy(stdin, s)
+				stdin.Close()
+			}()
+
+			err = c.Wait()
+			var exitErr *exec.ExitError
+			switch {
+			case errors.As(err, &exitErr):
+				code := exitErr.ExitCode()
+				if code < 0 {
+					code = 1
+				}
+				s.Exit(code)
+			case err != nil:
+				wish.Fatalln(s, err)
+			default:
+				s.Exit(0)
+			}
+		}
+	}
+}
+
+// execEnv returns environ with the variables restricting the command of a
+// session and setting up its auditor, replacing those already set.
+func execEnv(environ, roots []string, readOnly bool, auditor audit.Auditor) []string {
+	env := make([]string, 0, len(environ)+10)
+	for _, v := range environ {
+		if !strings.HasPrefix(v, EnvExec+"=") && !strings.HasPrefix(v, EnvExec+"_") {
+			env = append(env, v)
+		}
+	}
+	env = append(env, EnvExec+"=1")
+	if len(roots) > 0 {
+		env = append(env, EnvExecRoots+"="+strings.Join(roots, string(filepath.ListSeparator)))
+	}
+	if readOnly {
+		env = append(env, EnvExecReadOnly+"=1")
+	}
+	return append(env,
+		EnvExecAuditLog+"="+auditor.Log.Path,
+		EnvExecAuditMaxSize+"="+strconv.FormatInt(auditor.Log.MaxSize, 10),
+		EnvExecAuditBackups+"="+strconv.Itoa(auditor.Log.MaxBackups),
+		EnvExecUser+"="+auditor.Client.User,
+		EnvExecKey+"="+auditor.Client.Key,
+		EnvExecKeyComment+"="+auditor.Client.KeyComment,
+		EnvExecRemote+"="+auditor.Client.Remote,
+	)
+}
+
+// ExecAuditor returns the auditor of the session whose command tgcom runs,
+// as set up by the server in the environment. ok is false outside of the
+// commands of sessions.
+func ExecAuditor() (auditor audit.Auditor, ok bool, err error) {
+	if os.Getenv(EnvExec) != "1" {
+		return audit.Auditor{}, false, nil
+	}
+	path := os.Getenv(EnvExecAuditLog)
+	if path == "" {
+		return audit.Auditor{}, false, errors.New("no audit log: the command of the session cannot be audited")
+	}
+	log := &audit.Logger{Path: path}
+	if log.MaxSize, err = strconv.ParseInt(os.Getenv(EnvExecAuditMaxSize), 10, 64); err != nil {
+		return audit.Auditor{}, false, fmt.Errorf("invalid %s: %w", EnvExecAuditMaxSize, err)
+	}
+	if log.MaxBackups, err = strconv.Atoi(os.Getenv(EnvExecAuditBackups)); err != nil {
+		return audit.Auditor{}, false, fmt.Errorf("invalid %s: %w", EnvExecAuditBackups, err)
+	}
+	return audit.Auditor{Log: log, Client: audit.Client{
+		User:       os.Getenv(EnvExecUser),
+		Key:        os.Getenv(EnvExecKey),
+		KeyComment: os.Getenv(EnvExecKeyComment),
+		Remote:     os.Getenv(EnvExecRemote),
+	}}, true, nil
+}
@@ -2,10 +2,14 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,7 +20,7 @@ import (
 	"github.com/charmbracelet/wish/activeterm"
 	bm "github.com/charmbracelet/wish/bubbletea"
 	lm "github.com/charmbracelet/wish/logging"
-	"github.com/dyne/tgcom/utils/tui"
+	"github.com/dyne/tgcom/utils/audit"
 	"github.com/dyne/tgcom/utils/tui/modelutils"
 )
 
@@ -24,64 +28,165 @@ const (
 	envHostKey = "_TGCOM_HOSTKEY"
 )
 
+// DefaultPort is the port the server listens on, and clients connect to,
+// when none is configured.
+const DefaultPort = 2222
+
+// unixPrefix marks listen addresses that are paths of unix sockets.
+const unixPrefix = "unix:"
+
 var (
-	pathTgcom   = filepath.Join(xdg.DataHome, "tgcom")
-	pathHostKey = filepath.Join(pathTgcom, "hostkey")
-	teaOptions  = []tea.ProgramOption{tea.WithAltScreen(), tea.WithOutput(os.Stderr)}
-	dir         string
+	pathTgcom          = filepath.Join(xdg.DataHome, "tgcom")
+	pathHostKey        = filepath.Join(pathTgcom, "hostkey")
+	pathAuthorizedKeys = filepath.Join(xdg.ConfigHome, "tgcom", "authorized_keys")
+	pathAuditLog       = filepath.Join(pathTgcom, "audit.log")
+	teaOptions         = []tea.ProgramOption{tea.WithAltScreen(), tea.WithOutput(os.Stderr)}
 )
 
-func StartServer() {
+// Config holds the settings of the server.
+type Config struct {
+	Listen         []string // host:port, [ipv6]:port or unix:/path/to/socket, defaults to DefaultPort on all interfaces
+	HostKey        string   // Path of the host key, created if missing, defaults to the tgcom data directory
+	AuthorizedKeys string   // Path of the authorized_keys file, defaults to the tgcom configuration directory
+	NoAuth         bool     // Accept any connection without authentication
+	Roots          []string // If set, sessions can only browse these directories, unless their key has a root
+	ReadOnly       bool     // Sessions only preview changes, whatever their key
+	AuditLog       string   // Path of the log of the changes made by sessions, defaults to the tgcom data directory
+	AuditMaxSize   int64    // Size in bytes beyond which the audit log is rotated, defaults to audit.DefaultMaxSize
+	AuditBackups   int      // Number of rotated audit logs kept, defaults to audit.DefaultMaxBackups
+}
+
+// New returns the server for conf, which is not listening yet.
+func New(conf Config) (*ssh.Server, error) {
 	withHostKey := wish.WithHostKeyPath(pathHostKey)
-	if pem, ok := os.LookupEnv(envHostKey); ok {
+	if conf.HostKey != "" {
+		withHostKey = wish.WithHostKeyPath(conf.HostKey)
+	} else if pem, ok := os.LookupEnv(envHostKey); ok {
 		withHostKey = wish.WithHostKeyPEM([]byte(pem))
 	}
-	srv, err := wish.NewServer(
-		wish.WithAddress(":2222"),
+	roots, err := resolveRoots(conf.Roots)
+	if err != nil {
+		return nil, err
+	}
+	auditLog := &audit.Logger{Path: conf.AuditLog, MaxSize: conf.AuditMaxSize, MaxBackups: conf.AuditBackups}
+	if auditLog.Path == "" {
+		auditLog.Path = pathAuditLog
+	}
+	if auditLog.Path, err = filepath.Abs(auditLog.Path); err != nil {
+		return nil, err
+	}
+	var keys []Key
+	if !conf.NoAuth {
+		path := conf.AuthorizedKeys
+		if path == "" {
+			path = pathAuthorizedKeys
+		}
+		keys, err = LoadAuthorizedKeys(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no authorized keys file %s: add the public keys of the users to it, or accept any connection with --no-auth", path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	options := []ssh.Option{
 		wish.WithMiddleware(
-			bm.Middleware(func(s ssh.Session) (tea.Model, []tea.ProgramOption) {
-				pty, _, _ := s.Pty()
-				// Initialize the file selector model with the directory argument
-				model := tui.Model{
-					State:         "FileSelection",
-					FilesSelector: modelutils.InitialModel(dir, pty.Window.Height-5), // Initialize the FilesSelector model with window height
-				}
-				if model.Error != nil {
-					wish.Println(s, model.Error.Error())
-					return nil, nil
-				}
-				return model, teaOptions
-			}),
-			func(next ssh.Handler) ssh.Handler {
-				return func(s ssh.Session) {
-					command := s.Command()
-					if len(command) < 2 {
-						wish.Println(s, "Usage tgcom <directory>")
-						next(s)
-						return
-					}
-					dir = command[1]
-					next(s)
-				}
-			},
+			bm.Middleware(teaHandler),
+			sessionMiddleware(roots, keys, conf.ReadOnly, auditLog),
 			activeterm.Middleware(),
+			execMiddleware(roots, keys, conf.ReadOnly, auditLog),
 			lm.Middleware(),
 		),
 
 		withHostKey,
-	)
+	}
+	if !conf.NoAuth {
+		options = append(options, wish.WithPublicKeyAuth(publicKeyHandler(keys)))
+	}
+	return wish.NewServer(options...)
+}
+
+// resolveRoots returns the absolute paths of roots, without symbolic links.
+func resolveRoots(roots []string) ([]string, error) {
+	resolved := make([]string, len(roots))
+	for i, root := range roots {
+		path, err := filepath.EvalSymlinks(root)
+		if err == nil {
+			path, err = filepath.Abs(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %s: %w", root, err)
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid root %s: not a directory", root)
+		}
+		resolved[i] = path
+	}
+	return resolved, nil
+}
+
+// findRoot returns the first of roots containing dir, and the path of dir.
+// A relative dir is looked up in each root in turn.
+func findRoot(roots []string, dir string) (string, string, bool) {
+	for _, root := range roots {
+		path := dir
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, dir)
+		}
+		if modelutils.Within(root, path) {
+			return root, path, true
+		}
+	}
+	return "", "", false
+}
+
+// Listen listens on address, which is host:port, [ipv6]:port or
+// unix:/path/to/socket. A socket left behind by a previous server is
+// replaced.
+func Listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// StartServer serves on every address of conf until it is interrupted.
+func StartServer(conf Config) {
+	addresses := conf.Listen
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf(":%d", DefaultPort)}
+	}
+	srv, err := New(conf)
 	if err != nil {
 		log.Fatalf("could not create server: %s", err)
 	}
+
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		listener, err := Listen(address)
+		if err != nil {
+			log.Fatalf("could not listen on %s: %s", address, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	log.Printf("starting server: %s", srv.Addr)
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("server returned an error: %s", err)
-		}
-	}()
+	for i, listener := range listeners {
+		log.Printf("starting server: %s", addresses[i])
+		go func(listener net.Listener) {
+			if err := srv.Serve(listener); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
+				log.Fatalf("server returned an error: %s", err)
+			}
+		}(listener)
+	}
 
 	<-done
 	log.Println("stopping server...")
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestListen(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if _, ok := listener.Addr().(*net.TCPAddr); !ok {
+		t.Errorf("expected a TCP listener, got %v", listener.Addr())
+	}
+	listener.Close()
+
+	path := filepath.Join(t.TempDir(), "tgcom.sock")
+	// A socket left behind by a server that did not stop cleanly
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err = Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	defer listener.Close()
+	if conn, err := net.Dial("unix", path); err != nil {
+		t.Errorf("cannot connect to the socket: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// Other files are never removed
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix:" + file); err == nil {
+		t.Errorf("expected an error listening on a regular file")
+	}
+}
+
+// newKey returns a new signer and its authorized_keys line.
+func newKey(t *testing.T) (gossh.Signer, string) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, strings.TrimSpace(string(gossh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+// serve starts a server for conf on a local port and returns its address.
+func serve(t *testing.T, conf Config) string {
+	t.Helper()
+	conf.HostKey = filepath.Join(t.TempDir(), "hostkey")
+	if conf.AuditLog == "" {
+		conf.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	}
+	srv, err := New(conf)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return listener.Addr().String()
+}
+
+func dial(address string, signer gossh.Signer) (*gossh.Client, error) {
+	return gossh.Dial("tcp", address, &gossh.ClientConfig{
+		User:            "test",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+}
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	_, line := newKey(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	content := "# comment\n\n" + line + " alice\n" + `root="/srv/project",read-only ` + line + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	if len(keys) != 2 || keys[0].Comment != "alice" || keys[0].Root != "" || keys[0].ReadOnly {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	if keys[1].Root != "/srv/project" || !keys[1].ReadOnly {
+		t.Errorf("unexpected restrictions %+v", keys[1])
+	}
+
+	for _, options := range []string{`no-pty`, `root="relative"`, `root=/unquoted`} {
+		if err := os.WriteFile(path, []byte(options+" "+line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAuthorizedKeys(path); err == nil {
+			t.Errorf("expected an error for %s", options)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	if _, err := New(Config{HostKey: filepath.Join(t.TempDir(), "hostkey"), AuthorizedKeys: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Errorf("expected an error without authorized keys")
+	}
+
+	authorized, line := newKey(t)
+	other, _ := newKey(t)
+	root := t.TempDir()
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte(`root="`+root+`" `+line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	address := serve(t, Config{AuthorizedKeys: path})
+
+	if client, err := dial(address, other); err == nil {
+		client.Close()
+		t.Fatalf("expected a key that is not authorized to be refused")
+	}
+	client, err := dial(address, authorized)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	defer client.Close()
+
+	// The directory must be inside the root of the key
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err = session.Run("tgcom " + filepath.Dir(root))
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("expected exit status 1, got %v", err)
+	}
+	if !strings.Contains(stderr.String(), "is outside of the allowed directories: "+root) {
+		t.Errorf("unexpected output %q", stderr.String())
+	}
+}
+
+// keySession is a session authenticated with publicKey.
+type keySession struct {
+	ssh.Session
+	publicKey ssh.PublicKey
+}
+
+func (s keySession) PublicKey() ssh.PublicKey {
+	return s.publicKey
+}
+
+func TestSessionKey(t *testing.T) {
+	unrestricted, line := newKey(t)
+	restricted, restrictedLine := newKey(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte(line+"\n"+`root="/srv",read-only `+restrictedLine+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+
+	// The client queries the unrestricted key after the restricted one,
+	// then authenticates with the restricted key
+	handler := publicKeyHandler(keys)
+	if !handler(nil, restricted.PublicKey()) || !handler(nil, unrestricted.PublicKey()) {
+		t.Fatalf("expected the keys to be accepted")
+	}
+	key := sessionKey(keySession{publicKey: restricted.PublicKey()}, keys)
+	if key == nil || key.Root != "/srv" || !key.ReadOnly {
+		t.Errorf("expected the restrictions of the authenticated key, got %+v", key)
+	}
+
+	if key := sessionKey(keySession{}, nil); key != nil {
+		t.Errorf("expected no key without authentication, got %+v", key)
+	}
+}
+
+// openTUI starts the TUI for command in a new session of client and waits
+// until its output contains want.
+func openTUI(client *gossh.Client, command, want string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		return err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start(command); err != nil {
+		return err
+	}
+	defer stdin.Write([]byte("q"))
+
+	found := make(chan bool, 1)
+	go func() {
+		var output []byte
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdout.Read(buf)
+			output = append(output, buf[:n]...)
+			if bytes.Contains(output, []byte(want)) {
+				found <- true
+				return
+			}
+			if err != nil {
+				found <- false
+				return
+			}
+		}
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			return fmt.Errorf("%q: output does not contain %q", command, want)
+		}
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("%q: timed out waiting for %q", command, want)
+	}
+	return nil
+}
+
+func TestRoots(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "subdir", "file.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{HostKey: filepath.Join(t.TempDir(), "hostkey"), NoAuth: true, Roots: []string{filepath.Join(root, "missing")}}); err == nil {
+		t.Errorf("expected an error for a missing root")
+	}
+
+	address := serve(t, Config{NoAuth: true, Roots: []string{root}})
+	signer, _ := newKey(t)
+	client, err := dial(address, signer)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	defer client.Close()
+
+	// Relative directories are looked up in the roots
+	if err := openTUI(client, "tgcom subdir", "file.go"); err != nil {
+		t.Error(err)
+	}
+	// The first root is opened when no directory is given
+	if err := openTUI(client, "tgcom", "subdir"); err != nil {
+		t.Error(err)
+	}
+
+	for _, dir := range []string{filepath.Dir(root), filepath.Join(root, "..", filepath.Base(root)+"x"), "../"} {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+			t.Fatal(err)
+		}
+		var stderr bytes.Buffer
+		session.Stderr = &stderr
+		if err := session.Run("tgcom " + dir); err == nil {
+			t.Errorf("expected %s to be refused", dir)
+		}
+		if !strings.Contains(stderr.String(), "is outside of the allowed directories") {
+			t.Errorf("unexpected output %q", stderr.String())
+		}
+		session.Close()
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	const connections, sessions = 4, 4
+	dirs := make([]string, connections*sessions)
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+		if err := os.WriteFile(filepath.Join(dirs[i], fmt.Sprintf("file%d.go", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	address := serve(t, Config{NoAuth: true})
+	signer, _ := newKey(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(dirs))
+	for c := 0; c < connections; c++ {
+		client, err := dial(address, signer)
+		if err != nil {
+			t.Fatalf("No error expected got: %s", err)
+		}
+		defer client.Close()
+		// Sessions of the same connection share its context, so each of
+		// them must still see its own directory.
+		for s := 0; s < sessions; s++ {
+			i := c*sessions + s
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- openTUI(client, "tgcom "+dirs[i], fmt.Sprintf("file%d.go", i))
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMissingDirectory(t *testing.T) {
+	address := serve(t, Config{NoAuth: true})
+	signer, _ := newKey(t)
+	client, err := dial(address, signer)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run("tgcom"); err == nil {
+		t.Errorf("expected an error without a directory")
+	}
+	if !strings.Contains(stderr.String(), "Usage tgcom <directory>") {
+		t.Errorf("unexpected output %q", stderr.String())
+	}
+}
+
+// TestHelperProcess is the tgcom command run by the sessions of TestExec.
+// It prints its arguments, directory and restrictions, its auditor with the
+// audit argument, copies stdin with the stdin argument, and fails with the
+// fail argument.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("TGCOM_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	args = args[1:]
+	wd, _ := os.Getwd()
+	fmt.Printf("args=%s dir=%s exec=%s roots=%s read-only=%s\n", strings.Join(args, " "), wd,
+		os.Getenv(EnvExec), os.Getenv(EnvExecRoots), os.Getenv(EnvExecReadOnly))
+	if len(args) > 0 && args[0] == "audit" {
+		auditor, ok, err := ExecAuditor()
+		fmt.Printf("ok=%t err=%v log=%s user=%s key=%s\n", ok, err, auditor.Log.Path, auditor.Client.User, auditor.Client.Key)
+	}
+	if len(args) > 0 && args[0] == "stdin" {
+		io.Copy(os.Stdout, os.Stdin)
+	}
+	if len(args) > 0 && args[0] == "fail" {
+		fmt.Fprintln(os.Stderr, "failed")
+		os.Exit(3)
+	}
+	os.Exit(0)
+}
+
+// run runs command in a new session of client without a terminal.
+func run(client *gossh.Client, command, stdin string) (string, string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader(stdin)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(command)
+	return stdout.String(), stderr.String(), err
+}
+
+// useHelperProcess makes sessions run TestHelperProcess instead of tgcom.
+func useHelperProcess(t *testing.T) {
+	t.Setenv("TGCOM_WANT_HELPER_PROCESS", "1")
+	original := execCommand
+	t.Cleanup(func() { execCommand = original })
+	execCommand = func(ctx context.Context, args ...string) (*exec.Cmd, error) {
+		return exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--"}, args...)...), nil
+	}
+}
+
+func TestExec(t *testing.T) {
+	useHelperProcess(t)
+	// The variables of the server must not leak into the commands
+	t.Setenv(EnvExecReadOnly, "1")
+
+	root := t.TempDir()
+	authorized, line := newKey(t)
+	readOnly, readOnlyLine := newKey(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte(line+"\n"+`root="`+root+`",read-only `+readOnlyLine+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	address := serve(t, Config{AuthorizedKeys: path, AuditLog: auditLog})
+	client, err := dial(address, authorized)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	defer client.Close()
+
+	wd, _ := os.Getwd()
+	stdout, _, err := run(client, "tgcom -f main.go -l 3 -a comment --dry-run", "")
+	if err != nil {
+		t.Errorf("No error expected got: %s", err)
+	}
+	if want := "args=-f main.go -l 3 -a comment --dry-run dir=" + wd + " exec=1 roots= read-only=\n"; stdout != want {
+		t.Errorf("expected %q, got %q", want, stdout)
+	}
+
+	// The command records its changes for the client
+	stdout, _, _ = run(client, "tgcom audit", "")
+	if want := "\nok=true err=<nil> log=" + auditLog + " user=test key=" + gossh.FingerprintSHA256(authorized.PublicKey()) + "\n"; !strings.HasSuffix(stdout, want) {
+		t.Errorf("expected %q, got %q", want, stdout)
+	}
+
+	if stdout, _, _ := run(client, "tgcom stdin", "package main\n"); !strings.HasSuffix(stdout, "\npackage main\n") {
+		t.Errorf("expected stdin to be passed to the command, got %q", stdout)
+	}
+
+	_, stderr, err := run(client, "tgcom fail", "")
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	if stderr != "failed\n" {
+		t.Errorf("unexpected output %q", stderr)
+	}
+
+	_, stderr, err = run(client, "ls /", "")
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 || !strings.Contains(stderr, "unknown command ls") {
+		t.Errorf("expected ls to be refused, got %v: %q", err, stderr)
+	}
+
+	// The restrictions of the key are passed to the command
+	restricted, err := dial(address, readOnly)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	defer restricted.Close()
+	stdout, _, err = run(restricted, "tgcom -f main.go", "")
+	if err != nil {
+		t.Errorf("No error expected got: %s", err)
+	}
+	if want := "args=-f main.go dir=" + root + " exec=1 roots=" + root + " read-only=1\n"; stdout != want {
+		t.Errorf("expected %q, got %q", want, stdout)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	useHelperProcess(t)
+	root := t.TempDir()
+	address := serve(t, Config{NoAuth: true, ReadOnly: true})
+	signer, _ := newKey(t)
+	client, err := dial(address, signer)
+	if err != nil {
+		t.Fatalf("No error expected got: %s", err)
+	}
+	defer client.Close()
+
+	if err := openTUI(client, "tgcom "+root, "READ-ONLY SESSION"); err != nil {
+		t.Error(err)
+	}
+	stdout, _, err := run(client, "tgcom -f main.go -l 3", "")
+	if err != nil {
+		t.Errorf("No error expected got: %s", err)
+	}
+	if !strings.Contains(stdout, " read-only=1\n") {
+		t.Errorf("expected the command to be read-only, got %q", stdout)
+	}
+}
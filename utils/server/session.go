@@ -0,0 +1,128 @@
+package server
+
+import (
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/dyne/tgcom/utils/audit"
+	"github.com/dyne/tgcom/utils/tui"
+	"github.com/dyne/tgcom/utils/tui/modelutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sessionInfo is what the handlers of a session know about it.
+type sessionInfo struct {
+	Dir      string // Directory to browse
+	Root     string // If set, the session cannot leave this directory
+	User     string
+	Key      *Key // Key the session was authenticated with, nil without authentication
+	ReadOnly bool // Files cannot be modified, only previews of the changes are shown
+	Width    int
+	Height   int
+	Audit    audit.Auditor // Records the changes made by the session
+}
+
+// sessionContextKey stores the sessionInfo of a session. The context is
+// shared by all the sessions of a connection, so the key holds the session.
+type sessionContextKey struct {
+	ssh.Session
+}
+
+// getSessionInfo returns the information stored by sessionMiddleware for s.
+func getSessionInfo(s ssh.Session) *sessionInfo {
+	info, _ := s.Context().Value(sessionContextKey{s}).(*sessionInfo)
+	return info
+}
+
+// sessionMiddleware checks the directory requested by a session against
+// roots, or against the root of its key among keys, and stores the
+// sessionInfo of the session, whose changes are recorded in auditLog, for
+// the next handlers. All the sessions are read-only with readOnly, else
+// those of read-only keys.
+func sessionMiddleware(roots []string, keys []Key, readOnly bool, auditLog *audit.Logger) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(s ssh.Session) {
+			pty, _, _ := s.Pty()
+			info := &sessionInfo{
+				User:   s.User(),
+				Key:    sessionKey(s, keys),
+				Width:  pty.Window.Width,
+				Height: pty.Window.Height,
+			}
+			info.ReadOnly = readOnly || info.Key != nil && info.Key.ReadOnly
+			info.Audit = audit.Auditor{Log: auditLog, Client: auditClient(s, info.Key)}
+
+			command := s.Command()
+			allowed := allowedRoots(roots, info.Key)
+			switch {
+			case len(allowed) > 0:
+				requested := allowed[0]
+				if len(command) >= 2 {
+					requested = command[1]
+				}
+				root, path, ok := findRoot(allowed, requested)
+				if !ok {
+					wish.Fatalf(s, "%s is outside of the allowed directories: %s\n", requested, strings.Join(allowed, ", "))
+					return
+				}
+				info.Root, info.Dir = root, path
+			case len(command) < 2:
+				wish.Fatalln(s, "Usage tgcom <directory>")
+				return
+			default:
+				info.Dir = command[1]
+			}
+
+			key := sessionContextKey{s}
+			s.Context().SetValue(key, info)
+			defer s.Context().SetValue(key, nil)
+			next(s)
+		}
+	}
+}
+
+// allowedRoots returns the directories the sessions of key can access: the
+// root of the key if it has one, else roots. None means any directory.
+func allowedRoots(roots []string, key *Key) []string {
+	if key != nil && key.Root != "" {
+		return []string{key.Root}
+	}
+	return roots
+}
+
+// auditClient returns the client of s, authenticated with key, as recorded
+// in the audit log.
+func auditClient(s ssh.Session, key *Key) audit.Client {
+	client := audit.Client{User: s.User(), Remote: s.RemoteAddr().String()}
+	if key != nil {
+		client.Key = gossh.FingerprintSHA256(key.PublicKey)
+		client.KeyComment = key.Comment
+	}
+	return client
+}
+
+// teaHandler returns the TUI browsing the directory of the session.
+func teaHandler(s ssh.Session) (tea.Model, []tea.ProgramOption) {
+	info := getSessionInfo(s)
+	if info == nil {
+		return nil, nil
+	}
+	// Initialize the file selector model with the directory argument
+	model := tui.Model{
+		State:         "FileSelection",
+		FilesSelector: modelutils.InitialModel(info.Dir, info.Height-5), // Initialize the FilesSelector model with window height
+		ReadOnly:      info.ReadOnly,
+		Editor:        info.Audit,
+		Height:        info.Height,
+	}
+	if info.Root != "" {
+		model.FilesSelector = modelutils.InitialJailedModel(info.Dir, info.Root, info.Height-5)
+	}
+	if model.Error != nil {
+		wish.Println(s, model.Error.Error())
+		return nil, nil
+	}
+	return model, teaOptions
+}
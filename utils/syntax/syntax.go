@@ -0,0 +1,434 @@
+// Package syntax tells code, comments and string contents apart, line by
+// line, so that commenting never touches the text of a string literal.
+//
+// It is a hand-written lexer rather than tree-sitter, whose Go bindings need
+// cgo, and only knows the tokens described by a Grammar. It does not handle
+// nested block comments (Rust, Swift, Haskell), C++ raw strings, Lua long
+// brackets with = levels, Rust raw strings with more than two #, regular
+// expression literals, quotes inside string interpolation, several heredocs
+// opened on one line, or backslash line continuations.
+package syntax
+
+import "strings"
+
+// Kind classifies a line of source code.
+type Kind int
+
+const (
+	// Code is a line with at least some code on it.
+	Code Kind = iota
+	// Comment is a line holding nothing but comments.
+	Comment
+	// String is a line that starts inside a string literal or heredoc, so
+	// its text belongs to the string and must not be modified.
+	String
+	// Blank is an empty or whitespace-only line.
+	Blank
+)
+
+// Delim describes a string literal.
+type Delim struct {
+	Open      string
+	Close     string
+	Escape    bool // A backslash escapes the next character
+	Multiline bool // The literal may span several lines
+}
+
+// Grammar holds the lexical rules needed to tell code, comments and strings
+// apart. It is not a full parser: only the tokens that change how the rest
+// of a line is read are described.
+type Grammar struct {
+	LineComments  []string
+	BlockComments [][2]string
+	Strings       []Delim // Longer delimiters must come first
+	// Heredoc is the operator starting a heredoc ("<<" or "<<<"), if any
+	Heredoc string
+	// CommentAfterSpace requires line comments to start a word, as the # of
+	// shell scripts does
+	CommentAfterSpace bool
+}
+
+var (
+	cStrings = []Delim{
+		{Open: `"`, Close: `"`, Escape: true},
+		{Open: `'`, Close: `'`, Escape: true},
+	}
+	cComments      = []string{"//"}
+	cBlockComments = [][2]string{{"/*", "*/"}}
+
+	cGrammar = &Grammar{LineComments: cComments, BlockComments: cBlockComments, Strings: cStrings}
+
+	goGrammar = &Grammar{
+		LineComments:  cComments,
+		BlockComments: cBlockComments,
+		Strings: []Delim{
+			{Open: "`", Close: "`", Multiline: true},
+			{Open: `"`, Close: `"`, Escape: true},
+			{Open: `'`, Close: `'`, Escape: true},
+		},
+	}
+
+	jsGrammar = &Grammar{
+		LineComments:  cComments,
+		BlockComments: cBlockComments,
+		Strings: []Delim{
+			{Open: "`", Close: "`", Escape: true, Multiline: true},
+			{Open: `"`, Close: `"`, Escape: true},
+			{Open: `'`, Close: `'`, Escape: true},
+		},
+	}
+
+	// Java, Kotlin, Scala, Swift and Dart have triple-quoted text blocks
+	textBlockGrammar = &Grammar{
+		LineComments:  cComments,
+		BlockComments: cBlockComments,
+		Strings: []Delim{
+			{Open: `"""`, Close: `"""`, Escape: true, Multiline: true},
+			{Open: `'''`, Close: `'''`, Escape: true, Multiline: true},
+			{Open: `"`, Close: `"`, Escape: true},
+			{Open: `'`, Close: `'`, Escape: true},
+		},
+	}
+
+	rustGrammar = &Grammar{
+		LineComments:  cComments,
+		BlockComments: cBlockComments,
+		Strings: []Delim{
+			{Open: `r##"`, Close: `"##`, Multiline: true},
+			{Open: `r#"`, Close: `"#`, Multiline: true},
+			{Open: `r"`, Close: `"`, Multiline: true},
+			{Open: `"`, Close: `"`, Escape: true, Multiline: true},
+		},
+	}
+
+	phpGrammar = &Grammar{
+		LineComments:  []string{"//", "#"},
+		BlockComments: cBlockComments,
+		Strings: []Delim{
+			{Open: `"`, Close: `"`, Escape: true, Multiline: true},
+			{Open: `'`, Close: `'`, Escape: true, Multiline: true},
+		},
+		Heredoc: "<<<",
+	}
+
+	pythonGrammar = &Grammar{
+		LineComments: []string{"#"},
+		Strings: []Delim{
+			{Open: `"""`, Close: `"""`, Escape: true, Multiline: true},
+			{Open: `'''`, Close: `'''`, Escape: true, Multiline: true},
+			{Open: `"`, Close: `"`, Escape: true},
+			{Open: `'`, Close: `'`, Escape: true},
+		},
+	}
+
+	shellGrammar = &Grammar{
+		LineComments: []string{"#"},
+		Strings: []Delim{
+			{Open: `"`, Close: `"`, Escape: true, Multiline: true},
+			{Open: `'`, Close: `'`, Multiline: true},
+		},
+		Heredoc:           "<<",
+		CommentAfterSpace: true,
+	}
+
+	rubyGrammar = &Grammar{
+		LineComments:  []string{"#"},
+		BlockComments: [][2]string{{"=begin", "=end"}},
+		Strings: []Delim{
+			{Open: `"`, Close: `"`, Escape: true, Multiline: true},
+			{Open: `'`, Close: `'`, Escape: true, Multiline: true},
+		},
+		Heredoc: "<<",
+	}
+
+	elixirGrammar = &Grammar{
+		LineComments: []string{"#"},
+		Strings: []Delim{
+			{Open: `"""`, Close: `"""`, Escape: true, Multiline: true},
+			{Open: `'''`, Close: `'''`, Escape: true, Multiline: true},
+			{Open: `"`, Close: `"`, Escape: true, Multiline: true},
+			{Open: `'`, Close: `'`, Escape: true, Multiline: true},
+		},
+	}
+
+	luaGrammar = &Grammar{
+		LineComments:  []string{"--"},
+		BlockComments: [][2]string{{"--[[", "]]"}},
+		Strings: []Delim{
+			{Open: `[[`, Close: `]]`, Multiline: true},
+			{Open: `"`, Close: `"`, Escape: true},
+			{Open: `'`, Close: `'`, Escape: true},
+		},
+	}
+
+	sqlGrammar = &Grammar{
+		LineComments:  []string{"--"},
+		BlockComments: cBlockComments,
+		Strings: []Delim{
+			{Open: `'`, Close: `'`, Multiline: true},
+			{Open: `"`, Close: `"`, Multiline: true},
+		},
+	}
+
+	haskellGrammar = &Grammar{
+		LineComments:  []string{"--"},
+		BlockComments: [][2]string{{"{-", "-}"}},
+		Strings:       []Delim{{Open: `"`, Close: `"`, Escape: true}},
+	}
+
+	rGrammar = &Grammar{
+		LineComments: []string{"#"},
+		Strings: []Delim{
+			{Open: `"`, Close: `"`, Escape: true, Multiline: true},
+			{Open: `'`, Close: `'`, Escape: true, Multiline: true},
+		},
+	}
+)
+
+// grammars maps the language names used by modfile.CommentChars to their
+// grammar. Languages missing here fall back to plain prefix matching.
+var grammars = map[string]*Grammar{
+	"golang":      goGrammar,
+	"go":          goGrammar,
+	"c":           cGrammar,
+	"c++":         cGrammar,
+	"objective-c": cGrammar,
+	"js":          jsGrammar,
+	"ts":          jsGrammar,
+	"java":        textBlockGrammar,
+	"kotlin":      textBlockGrammar,
+	"scala":       textBlockGrammar,
+	"swift":       textBlockGrammar,
+	"dart":        textBlockGrammar,
+	"rust":        rustGrammar,
+	"php":         phpGrammar,
+	"python":      pythonGrammar,
+	"bash":        shellGrammar,
+	"zenroom":     shellGrammar,
+	"slangroom":   shellGrammar,
+	"perl":        shellGrammar,
+	"ruby":        rubyGrammar,
+	"elixir":      elixirGrammar,
+	"lua":         luaGrammar,
+	"sql":         sqlGrammar,
+	"haskell":     haskellGrammar,
+	"r":           rGrammar,
+}
+
+// Lookup returns the grammar of lang, or nil if there is none.
+func Lookup(lang string) *Grammar {
+	return grammars[strings.ToLower(lang)]
+}
+
+// Lexer classifies the lines of a source file one at a time, carrying open
+// strings, block comments and heredocs from one line to the next.
+type Lexer struct {
+	grammar   *Grammar
+	inString  *Delim
+	inComment *[2]string
+	heredoc   string
+}
+
+// NewLexer returns a lexer for grammar, or nil if grammar is nil.
+func NewLexer(grammar *Grammar) *Lexer {
+	if grammar == nil {
+		return nil
+	}
+	return &Lexer{grammar: grammar}
+}
+
+// Next classifies line, which must be the line following the one passed to
+// the previous call, without its line terminator.
+func (l *Lexer) Next(line string) Kind {
+	if l.heredoc != "" {
+		if isHeredocEnd(line, l.heredoc) {
+			l.heredoc = ""
+		}
+		return String
+	}
+
+	startsInString := l.inString != nil
+	hasComment := l.inComment != nil
+	hasCode := false
+	pendingHeredoc := ""
+
+	for i := 0; i < len(line); {
+		if l.inString != nil {
+			end, ok := closeString(line, i, *l.inString)
+			if !ok {
+				break
+			}
+			i = end
+			l.inString = nil
+			continue
+		}
+		if l.inComment != nil {
+			end := strings.Index(line[i:], l.inComment[1])
+			if end < 0 {
+				break
+			}
+			i += end + len(l.inComment[1])
+			l.inComment = nil
+			continue
+		}
+
+		if line[i] == ' ' || line[i] == '\t' || line[i] == '\r' {
+			i++
+			continue
+		}
+		// Block comments first: Lua's --[[ starts with its line comment marker
+		if block, ok := l.blockCommentAt(line, i); ok {
+			l.inComment = block
+			hasComment = true
+			i += len(block[0])
+			continue
+		}
+		if l.lineCommentAt(line, i) {
+			hasComment = true
+			break
+		}
+		if id, end, ok := l.heredocAt(line, i); ok {
+			pendingHeredoc = id
+			hasCode = true
+			i = end
+			continue
+		}
+		if delim, ok := l.stringAt(line, i); ok {
+			l.inString = delim
+			hasCode = true
+			i += len(delim.Open)
+			continue
+		}
+		hasCode = true
+		i++
+	}
+
+	// Single-line strings cannot stay open past the end of the line
+	if l.inString != nil && !l.inString.Multiline {
+		l.inString = nil
+	}
+	if pendingHeredoc != "" {
+		l.heredoc = pendingHeredoc
+	}
+
+	switch {
+	case startsInString:
+		return String
+	case hasCode:
+		return Code
+	case hasComment:
+		return Comment
+	default:
+		return Blank
+	}
+}
+
+// Open reports whether the last line passed to Next ended inside a
+// multi-line string, a block comment or a heredoc, which the next line
+// continues.
+func (l *Lexer) Open() bool {
+	return l.inString != nil || l.inComment != nil || l.heredoc != ""
+}
+
+func (l *Lexer) lineCommentAt(line string, i int) bool {
+	for _, marker := range l.grammar.LineComments {
+		if !strings.HasPrefix(line[i:], marker) {
+			continue
+		}
+		if l.grammar.CommentAfterSpace && i > 0 && !strings.ContainsRune(" \t;", rune(line[i-1])) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func (l *Lexer) blockCommentAt(line string, i int) (*[2]string, bool) {
+	for j := range l.grammar.BlockComments {
+		if strings.HasPrefix(line[i:], l.grammar.BlockComments[j][0]) {
+			return &l.grammar.BlockComments[j], true
+		}
+	}
+	return nil, false
+}
+
+func (l *Lexer) stringAt(line string, i int) (*Delim, bool) {
+	for j := range l.grammar.Strings {
+		if strings.HasPrefix(line[i:], l.grammar.Strings[j].Open) {
+			return &l.grammar.Strings[j], true
+		}
+	}
+	return nil, false
+}
+
+// heredocAt recognizes <<ID, <<-ID, <<~ID, <<'ID' and <<"ID" (or the <<<
+// forms of PHP) and returns the terminator and the end of the operator.
+func (l *Lexer) heredocAt(line string, i int) (string, int, bool) {
+	op := l.grammar.Heredoc
+	if op == "" || !strings.HasPrefix(line[i:], op) {
+		return "", 0, false
+	}
+	j := i + len(op)
+	if j < len(line) && line[j] == '<' {
+		// A here-string such as bash's <<<, not a heredoc
+		return "", 0, false
+	}
+	if j < len(line) && (line[j] == '-' || line[j] == '~') {
+		j++
+	}
+	quote := byte(0)
+	if j < len(line) && (line[j] == '\'' || line[j] == '"') {
+		quote = line[j]
+		j++
+	}
+	start := j
+	for j < len(line) && isIdentByte(line[j]) {
+		j++
+	}
+	if j == start || isDigit(line[start]) {
+		return "", 0, false
+	}
+	id := line[start:j]
+	if quote != 0 {
+		if j >= len(line) || line[j] != quote {
+			return "", 0, false
+		}
+		j++
+	}
+	return id, j, true
+}
+
+// isHeredocEnd reports whether line terminates the heredoc id. Indented
+// terminators and PHP's trailing punctuation are accepted.
+func isHeredocEnd(line, id string) bool {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, id) {
+		return false
+	}
+	rest := trimmed[len(id):]
+	return rest == "" || !isIdentByte(rest[0])
+}
+
+// closeString returns the position right after the end of the string
+// literal delim that is open at line[i:].
+func closeString(line string, i int, delim Delim) (int, bool) {
+	for i < len(line) {
+		if delim.Escape && line[i] == '\\' {
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(line[i:], delim.Close) {
+			return i + len(delim.Close), true
+		}
+		i++
+	}
+	return 0, false
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || isDigit(b)
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,138 @@
+package syntax
+
+import (
+	"strings"
+	"testing"
+)
+
+func classify(lang, src string) []Kind {
+	lexer := NewLexer(Lookup(lang))
+	var kinds []Kind
+	for _, line := range strings.Split(src, "\n") {
+		kinds = append(kinds, lexer.Next(line))
+	}
+	return kinds
+}
+
+func TestLexer(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		src      string
+		expected []Kind
+	}{
+		{
+			name:     "GoRawString",
+			lang:     "go",
+			src:      "query := `\n// not a comment\n`\n// a comment\nx := 1 // trailing",
+			expected: []Kind{Code, String, String, Comment, Code},
+		},
+		{
+			name:     "GoBlockComment",
+			lang:     "go",
+			src:      "/*\n * doc\n */\n\nx := \"/*\"\ny := 1",
+			expected: []Kind{Comment, Comment, Comment, Blank, Code, Code},
+		},
+		{
+			name:     "GoRuneWithBacktick",
+			lang:     "go",
+			src:      "r := '`'\n// comment",
+			expected: []Kind{Code, Comment},
+		},
+		{
+			name:     "GoEscapedQuote",
+			lang:     "go",
+			src:      "s := \"\\\"// not\"\n// comment",
+			expected: []Kind{Code, Comment},
+		},
+		{
+			name:     "PythonTripleQuotes",
+			lang:     "python",
+			src:      "doc = \"\"\"\n# not a comment\n\"\"\"\n# comment",
+			expected: []Kind{Code, String, String, Comment},
+		},
+		{
+			name:     "BashHeredoc",
+			lang:     "bash",
+			src:      "cat <<-EOF\n# not a comment\n\tEOF\n# comment\necho ${#var}",
+			expected: []Kind{Code, String, String, Comment, Code},
+		},
+		{
+			name:     "BashHereString",
+			lang:     "bash",
+			src:      "cat <<< \"x\"\n# comment",
+			expected: []Kind{Code, Comment},
+		},
+		{
+			name:     "LuaBlockComment",
+			lang:     "lua",
+			src:      "--[[\nprint(1)\n]]\n-- comment\ns = [[\n-- text\n]]",
+			expected: []Kind{Comment, Comment, Comment, Comment, Code, String, String},
+		},
+		{
+			name:     "JSTemplateLiteral",
+			lang:     "js",
+			src:      "const s = `\n// text\n`;",
+			expected: []Kind{Code, String, String},
+		},
+		{
+			name:     "RustRawString",
+			lang:     "rust",
+			src:      "let s = r#\"\n// \"text\n\"#;\n// comment",
+			expected: []Kind{Code, String, String, Comment},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.lang, tt.src)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %d lines, got %d", len(tt.expected), len(got))
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Errorf("line %d: expected kind %d, got %d", i+1, tt.expected[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if Lookup("GoLang") == nil {
+		t.Errorf("expected a grammar for golang")
+	}
+	if Lookup("html") != nil {
+		t.Errorf("expected no grammar for html")
+	}
+	if NewLexer(nil) != nil {
+		t.Errorf("expected no lexer without a grammar")
+	}
+}
+
+func TestLexerOpen(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		src      string
+		expected []bool
+	}{
+		{name: "GoRawString", lang: "go", src: "q := `\ntext\n` + f(`a`)", expected: []bool{true, true, false}},
+		{name: "GoString", lang: "go", src: "q := \"a\nb", expected: []bool{false, false}},
+		{name: "BlockComment", lang: "go", src: "x := 1 /* a\nb */ y := 2", expected: []bool{true, false}},
+		{name: "LineComment", lang: "go", src: "x := 1 // /* `", expected: []bool{false}},
+		{name: "Heredoc", lang: "bash", src: "cat <<EOF\ntext\nEOF", expected: []bool{true, true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lexer := NewLexer(Lookup(tt.lang))
+			for i, line := range strings.Split(tt.src, "\n") {
+				lexer.Next(line)
+				if lexer.Open() != tt.expected[i] {
+					t.Errorf("line %d: expected open %t, got %t", i+1, tt.expected[i], lexer.Open())
+				}
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package tui
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -20,6 +23,13 @@ type Model struct {
 	LabelType  []bool
 	CurrentDir string // Current directory for file selection
 	Error      error
+	Snapshots  map[string]modfile.Snapshot // State of each file when it was selected
+	ReadOnly   bool                        // Preview the changes instead of applying them
+	Editor     Editor                      // If set, files are read and changed with it instead of locally
+	Preview    string                      // Diff of the changes previewed by a read-only model
+	Height     int                         // Height of the terminal, for scrolling the preview
+
+	previewOffset int // First line of the preview shown
 
 	// Models for different selection steps
 	FilesSelector  modelutils.FilesSelector
@@ -28,9 +38,29 @@ type Model struct {
 	LabelInput     modelutils.LabelInput
 }
 
-// applyChangesMsg represents a message indicating that changes have been applied.
+// Editor reads and changes files that are not on the local file system,
+// such as those of a remote host.
+type Editor interface {
+	ReadFile(name string) ([]byte, error)
+	TakeSnapshot(name string) (modfile.Snapshot, error)
+	ChangeFile(conf modfile.Config) error
+}
+
+// ErrReadOnly is returned when files would be modified in a read-only
+// session.
+var ErrReadOnly = errors.New("read-only session: files cannot be modified")
+
+// readOnlyBanner is shown above every view of a read-only model.
+const readOnlyBanner = "READ-ONLY SESSION: changes are previewed, never written"
+
+// defaultHeight is the height of the terminal until its size is known.
+const defaultHeight = 24
+
+// applyChangesMsg represents a message indicating that changes have been
+// applied, or previewed by a read-only model.
 type applyChangesMsg struct {
-	err error
+	err     error
+	preview string
 }
 
 // Init initializes the model
@@ -50,10 +80,17 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if msg.err != nil {
 			m.Error = msg.err
 		}
+		m.Preview = msg.preview
 		m.State = "Final"
 		return m, nil
 
+	case tea.WindowSizeMsg:
+		m.Height = msg.Height
+
 	case tea.KeyMsg:
+		if m.State == "Final" && m.ReadOnly && m.Error == nil {
+			return m.scrollPreview(msg)
+		}
 		if m.State == "Final" {
 			return m, tea.Quit
 		}
@@ -69,6 +106,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, tea.Quit
 			}
 			m.Files = m.FilesSelector.FilesPath
+			m.Snapshots = m.takeSnapshots(m.Files)
 			if len(m.Files) == 1 {
 				m.SpeedSelector = modelutils.ModeSelector{
 					File:     m.Files[0],
@@ -216,8 +254,17 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
-// View renders the view based on the current state
+// View renders the view based on the current state, below a banner in
+// read-only models.
 func (m Model) View() string {
+	if m.ReadOnly {
+		return modelutils.Paint("red").Bold(true).Render(readOnlyBanner) + "\n\n" + m.stateView()
+	}
+	return m.stateView()
+}
+
+// stateView renders the view of the current state.
+func (m Model) stateView() string {
 	switch m.State {
 	case "FileSelection":
 		return m.FilesSelector.View()
@@ -228,43 +275,48 @@ func (m Model) View() string {
 	case "LabelInput":
 		return m.LabelInput.View()
 	case "ApplyChanges":
+		if m.ReadOnly {
+			return "Previewing changes..."
+		}
 		return "Applying changes..."
 	case "Final":
 		if m.Error != nil {
 			return modelutils.Paint("red").Render(fmt.Sprintf("An error occurred: %v\nPress any key to exit.", m.Error))
 		}
+		if m.ReadOnly {
+			return m.previewView()
+		}
 		return "Changes applied successfully!\nPress any key to exit."
 	}
 	return ""
 }
 
-// applyChanges applies changes to selected files based on user inputs
+// applyChanges applies changes to selected files based on user inputs, or
+// previews them in a read-only model.
 func (m *Model) applyChanges() tea.Cmd {
 	return func() tea.Msg {
+		if m.ReadOnly {
+			return m.previewChanges()
+		}
+		changeFile := modfile.ChangeFile
+		if m.Editor != nil {
+			changeFile = m.Editor.ChangeFile
+		}
 		for i := 0; i < len(m.Files); i++ {
-			currentFilePath, err := AbsToRel(m.Files[i])
-			if err != nil {
-				return applyChangesMsg{err: fmt.Errorf("failed to convert to relative path: %w", err)}
-			}
-			if !m.LabelType[i] {
-				conf := modfile.Config{
-					Filename: currentFilePath,
-					LineNum:  m.Labels[i],
-					Action:   m.Actions[i],
+			// Remote paths are not relative to the local directory
+			currentFilePath, err := m.Files[i], error(nil)
+			if m.Editor == nil {
+				currentFilePath, err = AbsToRel(m.Files[i])
+				if err != nil {
+					return applyChangesMsg{err: fmt.Errorf("failed to convert to relative path: %w", err)}
 				}
-				err = modfile.ChangeFile(conf)
-			} else {
-				parts := strings.Split(m.Labels[i], ";")
-				conf := modfile.Config{
-					Filename:   currentFilePath,
-					StartLabel: parts[0],
-					EndLabel:   parts[1],
-					Action:     m.Actions[i],
-				}
-				err = modfile.ChangeFile(conf)
 			}
-
-			if err != nil {
+			conf := m.changeConfig(i, currentFilePath)
+			// Refuse to overwrite edits made since the file was selected
+			if snapshot, ok := m.Snapshots[m.Files[i]]; ok {
+				conf.Expect = &snapshot
+			}
+			if err = changeFile(conf); err != nil {
 				return applyChangesMsg{err: fmt.Errorf("failed to apply changes to file %s: %w", m.Files[i], err)}
 			}
 		}
@@ -273,6 +325,121 @@ func (m *Model) applyChanges() tea.Cmd {
 	}
 }
 
+// changeConfig returns the change of the i-th selected file, at filename.
+func (m Model) changeConfig(i int, filename string) modfile.Config {
+	if !m.LabelType[i] {
+		return modfile.Config{
+			Filename: filename,
+			LineNum:  m.Labels[i],
+			Action:   m.Actions[i],
+		}
+	}
+	parts := strings.Split(m.Labels[i], ";")
+	return modfile.Config{
+		Filename:   filename,
+		StartLabel: parts[0],
+		EndLabel:   parts[1],
+		Action:     m.Actions[i],
+	}
+}
+
+// previewChanges returns the diff of the changes to the selected files,
+// without writing them.
+func (m Model) previewChanges() applyChangesMsg {
+	readFile := os.ReadFile
+	if m.Editor != nil {
+		readFile = m.Editor.ReadFile
+	}
+	var preview strings.Builder
+	for i, file := range m.Files {
+		content, err := readFile(file)
+		if err != nil {
+			return applyChangesMsg{err: fmt.Errorf("failed to preview changes to file %s: %w", file, err)}
+		}
+		var changed bytes.Buffer
+		if err := modfile.Change(bytes.NewReader(content), &changed, m.changeConfig(i, file)); err != nil {
+			return applyChangesMsg{err: fmt.Errorf("failed to preview changes to file %s: %w", file, err)}
+		}
+		preview.WriteString(modfile.Diff(file, content, changed.Bytes(), modfile.DefaultDiffContext))
+	}
+	if preview.Len() == 0 {
+		return applyChangesMsg{preview: "No line would change.\n"}
+	}
+	return applyChangesMsg{preview: preview.String()}
+}
+
+// previewHeight returns how many lines of the preview fit in the terminal.
+func (m Model) previewHeight() int {
+	height := m.Height
+	if height <= 0 {
+		height = defaultHeight
+	}
+	// The banner, the title and the help take 6 lines
+	return max(height-6, 1)
+}
+
+// scrollPreview scrolls the preview with the arrow and page keys, and quits
+// with the other keys.
+func (m Model) scrollPreview(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	lines := strings.Count(m.Preview, "\n")
+	switch msg.String() {
+	case "up", "k":
+		m.previewOffset--
+	case "down", "j":
+		m.previewOffset++
+	case "pgup", "b":
+		m.previewOffset -= m.previewHeight()
+	case "pgdown", " ", "f":
+		m.previewOffset += m.previewHeight()
+	default:
+		return m, tea.Quit
+	}
+	m.previewOffset = max(min(m.previewOffset, lines-m.previewHeight()), 0)
+	return m, nil
+}
+
+// previewView renders the visible lines of the preview, colored like a
+// diff.
+func (m Model) previewView() string {
+	lines := strings.Split(strings.TrimSuffix(m.Preview, "\n"), "\n")
+	end := min(m.previewOffset+m.previewHeight(), len(lines))
+	var b strings.Builder
+	b.WriteString("Preview of the changes, nothing was written:\n\n")
+	for _, line := range lines[m.previewOffset:end] {
+		switch {
+		case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+			line = modelutils.Paint("silver").Bold(true).Render(line)
+		case strings.HasPrefix(line, "@@"):
+			line = modelutils.Paint("grey").Render(line)
+		case strings.HasPrefix(line, "-"):
+			line = modelutils.Paint("red").Render(line)
+		case strings.HasPrefix(line, "+"):
+			line = modelutils.Paint("lime").Render(line)
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString(fmt.Sprintf("\nLines %d-%d of %d. Scroll with the arrows, press any other key to exit.", m.previewOffset+1, end, len(lines)))
+	return b.String()
+}
+
+// takeSnapshots records the state of the selected files, so that changes made
+// to them while the user goes through the remaining steps can be detected.
+// Files that cannot be read are skipped: applying changes to them reports
+// the error.
+func (m Model) takeSnapshots(files []string) map[string]modfile.Snapshot {
+	takeSnapshot := modfile.TakeSnapshot
+	if m.Editor != nil {
+		takeSnapshot = m.Editor.TakeSnapshot
+	}
+	snapshots := make(map[string]modfile.Snapshot, len(files))
+	for _, file := range files {
+		if snapshot, err := takeSnapshot(file); err == nil {
+			snapshots[file] = snapshot
+		}
+	}
+	return snapshots
+}
+
 // Helper function to convert absolute path to relative path
 func AbsToRel(absPath string) (string, error) {
 	// Get the current working directory
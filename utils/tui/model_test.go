@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dyne/tgcom/utils/modfile"
 	"github.com/dyne/tgcom/utils/tui/modelutils"
 	"github.com/stretchr/testify/assert"
 )
@@ -414,6 +416,116 @@ func TestModel(t *testing.T) {
 		}
 	})
 
+	t.Run("applyChanges file modified since selection", func(t *testing.T) {
+		tmpFile, cleanup := createTempFile(t, "start\nLine 1\nend\n", "file.go")
+		defer cleanup()
+
+		snapshots := Model{}.takeSnapshots([]string{tmpFile.Name()})
+		err := os.WriteFile(tmpFile.Name(), []byte("edited\n"), 0644)
+		assert.NoError(t, err)
+
+		model := Model{
+			Files:     []string{tmpFile.Name()},
+			Actions:   []string{"comment"},
+			Labels:    []string{"1"},
+			LabelType: []bool{false},
+			Snapshots: snapshots,
+		}
+		msg := model.applyChanges()()
+		err = msg.(applyChangesMsg).err
+		assert.ErrorIs(t, err, modfile.ErrFileChanged)
+
+		content, err := os.ReadFile(tmpFile.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, "edited\n", string(content))
+	})
+
+	t.Run("applyChanges read-only", func(t *testing.T) {
+		tmpFile, cleanup := createTempFile(t, "start\nLine 1\nend\n", "file.go")
+		defer cleanup()
+
+		model := Model{
+			Files:     []string{tmpFile.Name()},
+			Actions:   []string{"comment"},
+			Labels:    []string{"1"},
+			LabelType: []bool{false},
+			ReadOnly:  true,
+		}
+		msg := model.applyChanges()().(applyChangesMsg)
+		assert.NoError(t, msg.err)
+		name := tmpFile.Name()
+		assert.Equal(t, "--- "+name+"\n+++ "+name+"\n@@ -1,3 +1,3 @@\n-start\n+// start\n Line 1\n end\n", msg.preview)
+
+		content, err := os.ReadFile(tmpFile.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, "start\nLine 1\nend\n", string(content))
+	})
+
+	t.Run("applyChanges read-only editor", func(t *testing.T) {
+		editor := &fakeEditor{}
+		model := Model{
+			Files:     []string{"/srv/a.go"},
+			Actions:   []string{"uncomment"},
+			Labels:    []string{"start;end"},
+			LabelType: []bool{true},
+			ReadOnly:  true,
+			Editor:    editor,
+		}
+		msg := model.applyChanges()().(applyChangesMsg)
+		assert.NoError(t, msg.err)
+		assert.Equal(t, "No line would change.\n", msg.preview)
+		assert.Empty(t, editor.changes)
+	})
+
+	t.Run("read-only preview", func(t *testing.T) {
+		var preview strings.Builder
+		for i := 1; i <= 30; i++ {
+			fmt.Fprintf(&preview, "+line %d\n", i)
+		}
+		var m tea.Model = Model{State: "ApplyChanges", ReadOnly: true}
+		assert.Contains(t, m.View(), readOnlyBanner)
+		assert.Contains(t, m.View(), "Previewing changes...")
+
+		m, _ = m.Update(tea.WindowSizeMsg{Width: 80, Height: 16})
+		m, _ = m.Update(applyChangesMsg{preview: preview.String()})
+		view := m.View()
+		assert.Contains(t, view, readOnlyBanner)
+		assert.Contains(t, view, "nothing was written")
+		assert.Contains(t, view, "+line 10\n")
+		assert.NotContains(t, view, "+line 11\n")
+		assert.Contains(t, view, "Lines 1-10 of 30")
+
+		// Scrolling stops at the end of the preview
+		m, cmd := m.Update(tea.KeyMsg{Type: tea.KeyPgDown})
+		assert.Nil(t, cmd)
+		m, _ = m.Update(tea.KeyMsg{Type: tea.KeyPgDown})
+		m, _ = m.Update(tea.KeyMsg{Type: tea.KeyPgDown})
+		m, _ = m.Update(tea.KeyMsg{Type: tea.KeyUp})
+		assert.Contains(t, m.View(), "Lines 20-29 of 30")
+
+		_, cmd = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")})
+		assert.NotNil(t, cmd)
+	})
+
+	t.Run("applyChanges editor", func(t *testing.T) {
+		editor := &fakeEditor{}
+		model := Model{
+			Files:     []string{"/srv/a.go", "/srv/b.go"},
+			Actions:   []string{"comment", "toggle"},
+			Labels:    []string{"1-2", "start;end"},
+			LabelType: []bool{false, true},
+			Editor:    editor,
+		}
+		model.Snapshots = model.takeSnapshots(model.Files)
+		msg := model.applyChanges()()
+		assert.NoError(t, msg.(applyChangesMsg).err)
+		// Paths are passed as they are, with the snapshots of the editor
+		assert.Equal(t, []modfile.Config{
+			{Filename: "/srv/a.go", LineNum: "1-2", Action: "comment", Expect: &modfile.Snapshot{Size: int64(len("/srv/a.go"))}},
+			{Filename: "/srv/b.go", StartLabel: "start", EndLabel: "end", Action: "toggle", Expect: &modfile.Snapshot{Size: int64(len("/srv/b.go"))}},
+		}, editor.changes)
+	})
+
 	t.Run("View", func(t *testing.T) {
 		type viewTest struct {
 			name     string
@@ -481,3 +593,23 @@ func createTempFile(t testing.TB, content string, name string) (*os.File, func()
 	}
 	return temp, func() { os.Remove(temp.Name()) }
 }
+
+// fakeEditor records the changes it is asked for. Files hold their name
+// between the start and end labels, and the size of their snapshot is the
+// length of their name.
+type fakeEditor struct {
+	changes []modfile.Config
+}
+
+func (e *fakeEditor) ReadFile(name string) ([]byte, error) {
+	return []byte("start\n" + name + "\nend\n"), nil
+}
+
+func (e *fakeEditor) TakeSnapshot(name string) (modfile.Snapshot, error) {
+	return modfile.Snapshot{Size: int64(len(name))}, nil
+}
+
+func (e *fakeEditor) ChangeFile(conf modfile.Config) error {
+	e.changes = append(e.changes, conf)
+	return nil
+}
@@ -3,6 +3,7 @@ package modelutils
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -19,6 +20,11 @@ type FilesSelector struct {
 	WindowHeight        int
 	Error               error
 	NoFileSelected      bool
+	BinaryFiles         map[string]bool // The entries seen so far that look binary
+	Root                string          // If set, files and directories out of Root cannot be reached
+	FS                  FileSystem      // If set, files are browsed there instead of on the local file system
+	dirs                map[string]bool
+	sniffed             map[string]bool // The entries already checked for BinaryFiles
 }
 
 func InitialModel(currentDir string, windowHeight int) FilesSelector {
@@ -42,12 +48,45 @@ func InitialModel(currentDir string, windowHeight int) FilesSelector {
 		selectedFilesAndDir[i] = false
 	}
 
-	return FilesSelector{
+	m := FilesSelector{
 		CurrentDir:          currentDir,
 		FilesAndDir:         filesAndDir,
 		SelectedFilesAndDir: selectedFilesAndDir,
 		WindowHeight:        windowHeight,
 	}
+	m.sniffVisible()
+	return m
+}
+
+// InitialJailedModel is InitialModel for a selector that cannot leave root,
+// which must contain currentDir.
+func InitialJailedModel(currentDir, root string, windowHeight int) FilesSelector {
+	if !Within(root, currentDir) {
+		return FilesSelector{Error: fmt.Errorf("%s is outside of %s", currentDir, root)}
+	}
+	absDir, err := filepath.Abs(currentDir)
+	if err != nil {
+		return FilesSelector{Error: fmt.Errorf("error reading directory: %w", err)}
+	}
+	m := FilesSelector{WindowHeight: windowHeight, Root: root}
+	filesAndDir, err := m.readDir(absDir)
+	if err != nil {
+		return FilesSelector{Error: fmt.Errorf("error reading directory: %w", err)}
+	}
+	setDir(&m, absDir, filesAndDir)
+	return m
+}
+
+// InitialFSModel is InitialModel for a selector browsing fsys from
+// currentDir, an absolute path.
+func InitialFSModel(fsys FileSystem, currentDir string, windowHeight int) FilesSelector {
+	m := FilesSelector{WindowHeight: windowHeight, FS: fsys}
+	filesAndDir, err := m.readDir(currentDir)
+	if err != nil {
+		return FilesSelector{Error: fmt.Errorf("error reading directory: %w", err)}
+	}
+	setDir(&m, currentDir, filesAndDir)
+	return m
 }
 
 func (m FilesSelector) Init() tea.Cmd {
@@ -79,7 +118,7 @@ func (m FilesSelector) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		case "enter":
 			m.NoFileSelected = false
-			checkDir, err := IsDirectory(m.FilesAndDir[m.cursor])
+			checkDir, err := m.isDirectory(m.FilesAndDir[m.cursor])
 			if err != nil {
 				m.Error = fmt.Errorf("error checking directory: %w", err)
 				return m, tea.Quit
@@ -90,7 +129,7 @@ func (m FilesSelector) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.Error = fmt.Errorf("error checking directory: %w", err)
 					return m, tea.Quit
 				}
-			} else {
+			} else if !m.BinaryFiles[m.FilesAndDir[m.cursor]] {
 				if Contains(m.FilesPath, m.FilesAndDir[m.cursor]) {
 					m.FilesPath = Remove(m.FilesPath, m.FilesAndDir[m.cursor])
 				} else {
@@ -111,6 +150,7 @@ func (m FilesSelector) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.Done = true
 			}
 		}
+		m.sniffVisible()
 	}
 	return m, nil
 }
@@ -132,13 +172,15 @@ func (m FilesSelector) View() string {
 
 	for i := m.scrollOffset; i < m.scrollOffset+m.WindowHeight && i < len(m.FilesAndDir); i++ {
 		choice := m.FilesAndDir[i]
-		checkDir, err := IsDirectory(choice)
+		checkDir, err := m.isDirectory(choice)
 		if err != nil {
 			m.Error = fmt.Errorf("error checking directory: %w", err)
 			return Paint("red").Render(fmt.Sprintf("An error occurred: %v", m.Error))
 		}
 		if checkDir {
 			choice = Paint("blue").Render("❒ " + choice)
+		} else if m.BinaryFiles[choice] {
+			choice = Paint("grey").Render("❒ " + choice + " (binary)")
 		} else if Contains(m.FilesPath, choice) {
 			choice = Paint("lime").Render("❒ " + choice)
 		} else {
@@ -170,6 +212,9 @@ func Paint(color string) lipgloss.Style {
 	case "red":
 		red := lipgloss.Color("#FF0000")
 		return lipgloss.NewStyle().Foreground(red)
+	case "grey":
+		grey := lipgloss.Color("#808080")
+		return lipgloss.NewStyle().Foreground(grey)
 	case "silver":
 		silver := lipgloss.Color("#C0C0C0")
 		return lipgloss.NewStyle().Foreground(silver)
@@ -1,9 +1,13 @@
 package modelutils
 
 import (
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/stretchr/testify/assert"
@@ -236,3 +240,113 @@ func TestFilesSelectorView(t *testing.T) {
 		})
 	}
 }
+
+func TestJailedFilesSelector(t *testing.T) {
+	outside := t.TempDir()
+	root := t.TempDir()
+	subDir := filepath.Join(root, "subdir")
+	assert.NoError(t, os.Mkdir(subDir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "file.go"), nil, 0644))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+	assert.NoError(t, os.Symlink(filepath.Join(root, "file.go"), filepath.Join(subDir, "inside.go")))
+
+	m := InitialJailedModel(outside, root, 10)
+	assert.ErrorContains(t, m.Error, "is outside of")
+
+	// Links leading out of the root are not listed
+	m = InitialJailedModel(root, root, 10)
+	assert.NoError(t, m.Error)
+	assert.Equal(t, []string{filepath.Join(root, "file.go"), subDir}, m.FilesAndDir)
+
+	// The parent of the root cannot be reached
+	newModel, _ := m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	m = newModel.(FilesSelector)
+	assert.NoError(t, m.Error)
+	assert.Equal(t, root, m.CurrentDir)
+
+	m = InitialJailedModel(filepath.Join(root, "subdir", ".."), root, 10)
+	m.cursor = 1
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = newModel.(FilesSelector)
+	assert.Equal(t, subDir, m.CurrentDir)
+	assert.Equal(t, []string{filepath.Join(subDir, "inside.go")}, m.FilesAndDir)
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	m = newModel.(FilesSelector)
+	assert.Equal(t, root, m.CurrentDir)
+
+	// Moving into a directory out of the root directly is refused
+	assert.Error(t, moveToNextDir(&m, outside))
+}
+
+// mapFS is a FileSystem of absolute paths held in memory.
+type mapFS fstest.MapFS
+
+func (m mapFS) name(path string) string {
+	if path == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(path, "/")
+}
+
+func (m mapFS) ReadDir(dir string) ([]fs.FileInfo, error) {
+	entries, err := fs.ReadDir(fstest.MapFS(m), m.name(dir))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, len(entries))
+	for i, entry := range entries {
+		if infos[i], err = entry.Info(); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+func (m mapFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fstest.MapFS(m), m.name(name))
+}
+
+func (m mapFS) Open(name string) (io.ReadCloser, error) {
+	return fstest.MapFS(m).Open(m.name(name))
+}
+
+func TestFSFilesSelector(t *testing.T) {
+	fsys := mapFS{
+		"srv/project/main.go":   {Data: []byte("package main\n")},
+		"srv/project/image.png": {Data: []byte("\x89PNG\x00\x01")},
+		"srv/project/sub/a.go":  {Data: []byte("package sub\n")},
+	}
+
+	m := InitialFSModel(fsys, "/missing", 10)
+	assert.Error(t, m.Error)
+
+	m = InitialFSModel(fsys, "/srv/project", 10)
+	assert.NoError(t, m.Error)
+	assert.Equal(t, []string{"/srv/project/image.png", "/srv/project/main.go", "/srv/project/sub"}, m.FilesAndDir)
+	assert.Equal(t, map[string]bool{"/srv/project/image.png": true}, m.BinaryFiles)
+	view := stripANSI(m.View())
+	assert.Contains(t, view, "/srv/project/image.png (binary)")
+
+	m.cursor = 1
+	newModel, _ := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = newModel.(FilesSelector)
+	assert.Equal(t, []string{"/srv/project/main.go"}, m.FilesPath)
+
+	m.cursor = 2
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = newModel.(FilesSelector)
+	assert.NoError(t, m.Error)
+	assert.Equal(t, "/srv/project/sub", m.CurrentDir)
+	assert.Equal(t, []string{"/srv/project/sub/a.go"}, m.FilesAndDir)
+
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	m = newModel.(FilesSelector)
+	assert.Equal(t, "/srv/project", m.CurrentDir)
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	m = newModel.(FilesSelector)
+	assert.Equal(t, "/srv", m.CurrentDir)
+	// The root directory cannot be left
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	m = newModel.(FilesSelector)
+	assert.Error(t, m.Error)
+}
@@ -2,11 +2,25 @@ package modelutils
 
 import (
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dyne/tgcom/utils/modfile"
 )
 
+// FileSystem is a file system other than the local one that a FilesSelector
+// can browse, such as the one of a remote host. Paths are slash separated.
+type FileSystem interface {
+	ReadDir(dir string) ([]fs.FileInfo, error) // Entries of dir, without following symbolic links
+	Stat(name string) (fs.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+}
+
 func Contains(slice []string, str string) bool {
 	for _, item := range slice {
 		if item == str {
@@ -47,6 +61,16 @@ func GetParentDirectory(directoryPath string) (string, error) {
 	return parentDir, nil
 }
 
+// getFSParentDirectory is GetParentDirectory for the slash separated paths
+// of a FileSystem.
+func getFSParentDirectory(directoryPath string) (string, error) {
+	parentDir := path.Dir(directoryPath)
+	if parentDir == directoryPath || parentDir == "/" {
+		return "", fmt.Errorf("cannot move above the root directory")
+	}
+	return parentDir, nil
+}
+
 func GetPathOfEntry(entry fs.DirEntry, baseDir string) (string, error) {
 	_, err := entry.Info()
 	if err != nil {
@@ -61,65 +85,187 @@ func GetPathOfEntry(entry fs.DirEntry, baseDir string) (string, error) {
 	return absPath, nil
 }
 
-func moveToNextDir(filesSelector *FilesSelector, nextDirPath string) error {
-	var filesAndDirs []string
-	selectedFilesAndDirs := make(map[int]bool)
+// Within reports whether path is root or inside it, once symbolic links
+// are resolved, so that neither ".." nor a link can lead out of root.
+func Within(root, path string) bool {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	resolvedRoot, err = filepath.Abs(resolvedRoot)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
-	entries, err := os.ReadDir(nextDirPath)
+// readDir returns the absolute paths of the entries of dir. With Root set,
+// entries leading out of Root are left out.
+func (m *FilesSelector) readDir(dir string) ([]string, error) {
+	if m.FS != nil {
+		return m.readFSDir(dir)
+	}
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var paths []string
 	for _, entry := range entries {
-		entryPath, err := GetPathOfEntry(entry, nextDirPath)
+		entryPath, err := GetPathOfEntry(entry, dir)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		filesAndDirs = append(filesAndDirs, entryPath)
+		if m.Root != "" && !Within(m.Root, entryPath) {
+			continue
+		}
+		paths = append(paths, entryPath)
 	}
+	return paths, nil
+}
 
-	for i := 0; i < len(filesAndDirs); i++ {
-		selectedFilesAndDirs[i] = false
+// readFSDir returns the paths of the entries of dir in m.FS, sorted by
+// name, and records which of them are directories, as asking again for
+// each one to render the list would be slow.
+func (m *FilesSelector) readFSDir(dir string) ([]string, error) {
+	infos, err := m.FS.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
 
-	filesSelector.CurrentDir = nextDirPath
-	filesSelector.FilesAndDir = filesAndDirs
-	filesSelector.SelectedFilesAndDir = selectedFilesAndDirs
-	filesSelector.cursor = 0
-	filesSelector.scrollOffset = 0
-	return nil
+	paths := make([]string, 0, len(infos))
+	m.dirs = make(map[string]bool, len(infos))
+	for _, info := range infos {
+		entryPath := path.Join(dir, info.Name())
+		isDir := info.IsDir()
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if target, err := m.FS.Stat(entryPath); err == nil {
+				isDir = target.IsDir()
+			}
+		}
+		m.dirs[entryPath] = isDir
+		paths = append(paths, entryPath)
+	}
+	return paths, nil
 }
 
-func moveToPreviousDir(filesSelector *FilesSelector) error {
-	prevDirPath, err := GetParentDirectory(filesSelector.CurrentDir)
+// isDirectory is IsDirectory in the file system browsed by m.
+func (m FilesSelector) isDirectory(name string) (bool, error) {
+	if m.FS == nil {
+		return IsDirectory(name)
+	}
+	if isDir, ok := m.dirs[name]; ok {
+		return isDir, nil
+	}
+	info, err := m.FS.Stat(name)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return info.IsDir(), nil
+}
 
-	var filesAndDirs []string
-	selectedFilesAndDirs := make(map[int]bool)
+// isBinary reports whether the file name looks binary, and therefore cannot
+// be selected for editing. Directories and unreadable files are not binary.
+func (m FilesSelector) isBinary(name string) bool {
+	if isDir, err := m.isDirectory(name); err != nil || isDir {
+		return false
+	}
+	if m.FS == nil {
+		binary, err := modfile.IsBinary(name)
+		return err == nil && binary
+	}
+	file, err := m.FS.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	binary, err := modfile.IsBinaryReader(file)
+	return err == nil && binary
+}
 
-	entries, err := os.ReadDir(prevDirPath)
+// sniffVisible records in BinaryFiles which of the entries shown in the
+// window look binary. Entries are only read once they are scrolled into
+// view, so that opening a large directory does not read all of its files.
+func (m *FilesSelector) sniffVisible() {
+	if m.BinaryFiles == nil {
+		m.BinaryFiles = make(map[string]bool)
+	}
+	if m.sniffed == nil {
+		m.sniffed = make(map[string]bool)
+	}
+	end := m.scrollOffset + m.WindowHeight
+	if end <= m.cursor {
+		end = m.cursor + 1
+	}
+	for i := m.scrollOffset; i < end && i < len(m.FilesAndDir); i++ {
+		name := m.FilesAndDir[i]
+		if m.sniffed[name] {
+			continue
+		}
+		m.sniffed[name] = true
+		if m.isBinary(name) {
+			m.BinaryFiles[name] = true
+		}
+	}
+}
+
+func moveToNextDir(filesSelector *FilesSelector, nextDirPath string) error {
+	if filesSelector.Root != "" && !Within(filesSelector.Root, nextDirPath) {
+		return fmt.Errorf("%s is outside of %s", nextDirPath, filesSelector.Root)
+	}
+	filesAndDirs, err := filesSelector.readDir(nextDirPath)
 	if err != nil {
 		return err
 	}
+	setDir(filesSelector, nextDirPath, filesAndDirs)
+	return nil
+}
 
-	for _, entry := range entries {
-		entryPath, err := GetPathOfEntry(entry, prevDirPath)
-		if err != nil {
-			return err
-		}
-		filesAndDirs = append(filesAndDirs, entryPath)
+// moveToPreviousDir moves to the parent directory, unless that is out of
+// the root of the selector.
+func moveToPreviousDir(filesSelector *FilesSelector) error {
+	if filesSelector.Root != "" && !Within(filesSelector.Root, filepath.Dir(filesSelector.CurrentDir)) {
+		return nil
+	}
+	getParent := GetParentDirectory
+	if filesSelector.FS != nil {
+		getParent = getFSParentDirectory
+	}
+	prevDirPath, err := getParent(filesSelector.CurrentDir)
+	if err != nil {
+		return err
+	}
+	filesAndDirs, err := filesSelector.readDir(prevDirPath)
+	if err != nil {
+		return err
 	}
+	setDir(filesSelector, prevDirPath, filesAndDirs)
+	return nil
+}
 
+// setDir shows the entries of dir in the selector.
+func setDir(filesSelector *FilesSelector, dir string, filesAndDirs []string) {
+	selectedFilesAndDirs := make(map[int]bool)
 	for i := 0; i < len(filesAndDirs); i++ {
 		selectedFilesAndDirs[i] = false
 	}
 
-	filesSelector.CurrentDir = prevDirPath
+	filesSelector.CurrentDir = dir
 	filesSelector.FilesAndDir = filesAndDirs
 	filesSelector.SelectedFilesAndDir = selectedFilesAndDirs
+	filesSelector.BinaryFiles = make(map[string]bool)
+	filesSelector.sniffed = make(map[string]bool)
 	filesSelector.cursor = 0
 	filesSelector.scrollOffset = 0
-	return nil
+	filesSelector.sniffVisible()
 }
@@ -1,11 +1,13 @@
 package modelutils
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
 
+	tea "github.com/charmbracelet/bubbletea"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -148,3 +150,44 @@ func TestMoveToPreviousDir(t *testing.T) {
 		assert.Error(t, err, "An error is expected when moving to the previous directory from the root directory")
 	})
 }
+
+func TestBinaryFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	textFile := filepath.Join(tempDir, "main.go")
+	binaryFile := filepath.Join(tempDir, "image.png")
+	subDir := filepath.Join(tempDir, "subdir")
+	assert.NoError(t, os.WriteFile(textFile, []byte("package main\n"), 0644))
+	assert.NoError(t, os.WriteFile(binaryFile, []byte("\x89PNG\r\n\x1a\n\x00\x00"), 0644))
+	assert.NoError(t, os.Mkdir(subDir, 0755))
+
+	// Binary files are shown but cannot be selected
+	m := InitialModel(tempDir, 10)
+	assert.Equal(t, map[string]bool{binaryFile: true}, m.BinaryFiles)
+	m.cursor = 0
+	assert.Equal(t, binaryFile, m.FilesAndDir[0])
+	newModel, _ := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = newModel.(FilesSelector)
+	assert.Empty(t, m.FilesPath)
+	assert.Contains(t, m.View(), "(binary)")
+}
+
+func TestBinaryFilesSniffedWhenVisible(t *testing.T) {
+	tempDir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("%d.go", i)), []byte("package main\n"), 0644))
+	}
+	binaryFile := filepath.Join(tempDir, "image.png")
+	assert.NoError(t, os.WriteFile(binaryFile, []byte("\x89PNG\r\n\x1a\n\x00\x00"), 0644))
+
+	// Files below the window are not read
+	m := InitialModel(tempDir, 3)
+	assert.Empty(t, m.BinaryFiles)
+	assert.Len(t, m.sniffed, 3)
+
+	for i := 0; i < 5; i++ {
+		newModel, _ := m.Update(tea.KeyMsg{Type: tea.KeyDown})
+		m = newModel.(FilesSelector)
+	}
+	assert.Equal(t, binaryFile, m.FilesAndDir[m.cursor])
+	assert.Equal(t, map[string]bool{binaryFile: true}, m.BinaryFiles)
+}
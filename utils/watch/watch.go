@@ -0,0 +1,168 @@
+// Package watch re-applies changes to files whenever they are written, for
+// files that are regenerated and lose their toggled sections.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dyne/tgcom/utils/modfile"
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDebounce is how long a file must stay untouched after a write
+// before the changes are applied again.
+const DefaultDebounce = 200 * time.Millisecond
+
+// watcher holds the state of a running watch.
+type watcher struct {
+	conf     modfile.Config
+	patterns []string // absolute files, directories or glob patterns
+	logger   *log.Logger
+	applied  map[string]modfile.Snapshot // content written by the last application
+}
+
+// Run watches paths, which are files, directories or glob patterns in file
+// names, and applies conf to every matching file written, once it has not
+// been written for debounce. Files written by Run itself are not changed
+// again. Run returns nil when ctx is done.
+func Run(ctx context.Context, paths []string, conf modfile.Config, debounce time.Duration, logger *log.Logger) error {
+	patterns, dirs, err := resolve(paths)
+	if err != nil {
+		return err
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	for _, dir := range dirs {
+		if err := fsw.Add(dir); err != nil {
+			return fmt.Errorf("cannot watch %s: %w", dir, err)
+		}
+	}
+
+	w := &watcher{conf: conf, patterns: patterns, logger: logger, applied: make(map[string]modfile.Snapshot)}
+	timers := make(map[string]*time.Timer)
+	due := make(chan string)
+	defer func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) || !w.matches(event.Name) {
+				continue
+			}
+			name := event.Name
+			if timer, ok := timers[name]; ok {
+				timer.Reset(debounce)
+				continue
+			}
+			timers[name] = time.AfterFunc(debounce, func() {
+				select {
+				case due <- name:
+				case <-ctx.Done():
+				}
+			})
+		case name := <-due:
+			delete(timers, name)
+			w.apply(name)
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Printf("watch error: %v", err)
+		}
+	}
+}
+
+// resolve returns the absolute patterns for paths and the directories to
+// watch for them.
+func resolve(paths []string) ([]string, []string, error) {
+	var patterns, dirs []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		dir := filepath.Dir(abs)
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			dir = abs
+		}
+		if strings.ContainsAny(dir, "*?[") {
+			return nil, nil, fmt.Errorf("invalid path %s: patterns are only supported in file names", path)
+		}
+		patterns = append(patterns, abs)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return patterns, dirs, nil
+}
+
+// matches reports whether name is one of the watched files. Files in a
+// watched directory match unless they are hidden, backups, not regular files
+// or of an unknown language.
+func (w *watcher) matches(name string) bool {
+	base := filepath.Base(name)
+	for _, pattern := range w.patterns {
+		if pattern == filepath.Dir(name) {
+			if !strings.HasPrefix(base, ".") && !strings.HasSuffix(base, "~") && w.editable(name) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// editable reports whether name is a regular file of a known language.
+func (w *watcher) editable(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular() && modfile.Supported(name, w.conf.Lang)
+}
+
+// apply changes name unless its content is still what apply last wrote, as
+// recorded under the lock of the file so that a write right after it is not
+// mistaken for its own.
+func (w *watcher) apply(name string) {
+	current, err := modfile.TakeSnapshot(name)
+	if err != nil {
+		// Removed again before the changes could be applied
+		return
+	}
+	if last, ok := w.applied[name]; ok && last.Matches(current) {
+		return
+	}
+
+	var written modfile.Snapshot
+	conf := w.conf
+	conf.Filename = name
+	conf.Written = &written
+	if err := modfile.ChangeFile(conf); err != nil {
+		w.logger.Printf("failed to apply changes to %s: %v", name, err)
+		return
+	}
+	w.applied[name] = written
+	w.logger.Printf("applied changes to %s", name)
+}
@@ -0,0 +1,151 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dyne/tgcom/utils/modfile"
+)
+
+// syncBuffer is a log destination safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForContent(t *testing.T, filename, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		content, _ := os.ReadFile(filename)
+		if string(content) == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q, got %q", expected, content)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	generated := filepath.Join(dir, "gen.go")
+	other := filepath.Join(dir, "other.go")
+
+	var logs syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	conf := modfile.Config{StartLabel: "DEBUG-START", EndLabel: "DEBUG-END", Action: "comment"}
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, []string{filepath.Join(dir, "gen*.go")}, conf, 20*time.Millisecond, log.New(&logs, "", 0))
+	}()
+	// Give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	content := "package gen\n// DEBUG-START\nprintln()\n// DEBUG-END\n"
+	expected := "package gen\n// DEBUG-START\n// println()\n// DEBUG-END\n"
+	for _, file := range []string{generated, other} {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForContent(t, generated, expected)
+
+	// Its own write is not commented again, and other files are left alone
+	time.Sleep(200 * time.Millisecond)
+	waitForContent(t, generated, expected)
+	waitForContent(t, other, content)
+
+	// Regenerating the file applies the changes again
+	if err := os.WriteFile(generated, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForContent(t, generated, expected)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("No error expected got: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	if n := strings.Count(logs.String(), "applied changes to "+generated); n != 2 {
+		t.Errorf("expected 2 applications, got %d:\n%s", n, logs.String())
+	}
+}
+
+func TestMatches(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"main.go", "notes", ".hidden.go", "main.go~"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "pkg.go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &watcher{patterns: []string{dir, filepath.Join(dir, "gen*")}}
+	tests := map[string]bool{
+		"main.go":    true,
+		"notes":      false,
+		".hidden.go": false,
+		"main.go~":   false,
+		"pkg.go":     false,
+		"missing.go": false,
+		// Patterns name the files to watch themselves
+		"gen.txt": true,
+	}
+	for name, expected := range tests {
+		if got := w.matches(filepath.Join(dir, name)); got != expected {
+			t.Errorf("matches(%s) = %v, want %v", name, got, expected)
+		}
+	}
+}
+
+func TestApplyRecordsWritten(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "gen.go")
+	content := "package gen\n// DEBUG-START\nprintln()\n// DEBUG-END\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := modfile.Config{StartLabel: "DEBUG-START", EndLabel: "DEBUG-END", Action: "comment"}
+	w := &watcher{conf: conf, logger: log.New(&syncBuffer{}, "", 0), applied: make(map[string]modfile.Snapshot)}
+	w.apply(filename)
+
+	current, err := modfile.TakeSnapshot(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last, ok := w.applied[filename]; !ok || !last.Matches(current) {
+		t.Errorf("expected the snapshot of the content written, got %+v for %+v", last, current)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	if _, _, err := resolve([]string{"gen*/file.go"}); err == nil {
+		t.Errorf("expected an error for a pattern in a directory name")
+	}
+}